@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// hostUpdate is the body of PUT /api/v1/hosts/{name}. It replaces the
+// record set of the host; an omitted address removes the record. An omitted
+// TTL keeps the current one.
+type hostUpdate struct {
+	TTL  *uint       `json:"ttl"`
+	IPv4 *netip.Addr `json:"ipv4"`
+	IPv6 *netip.Addr `json:"ipv6"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("cannot encode response", "err", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// BasicAuthMiddleware checks HTTP basic auth credentials with the same user
+// and base64url encoded password as the updater. The password is validated
+// before the user is compared, so unknown users cost the same argon2id
+// derivation as the configured one.
+func BasicAuthMiddleware(user string, validate passwordValidator) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			unverifiedUser, passwd, ok := r.BasicAuth()
+
+			validPasswd := false
+			if decodedPasswd, err := base64.RawURLEncoding.DecodeString(passwd); ok && passwd != "" && err == nil {
+				validPasswd = validate(decodedPasswd)
+			}
+
+			if !validPasswd || unverifiedUser == "" || subtle.ConstantTimeCompare([]byte(user), []byte(unverifiedUser)) != 1 {
+				authFailuresTotal.Inc("")
+				w.Header().Set("WWW-Authenticate", `Basic realm="hostsharing-dyndns"`)
+				writeJSONError(w, http.StatusUnauthorized, "user or password wrong")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func listHostsHandler(s *zoneStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Hosts())
+	}
+}
+
+func getHostHandler(s *zoneStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := s.Host(chi.URLParam(r, "name"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown host")
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	}
+}
+
+// putHostHandler replaces the addresses of a host. With requireSourceMatch,
+// the address of the family the client connects with must be its own, like
+// SourceMatchMiddleware checks for the updater.
+func putHostHandler(s *zoneStore, requireSourceMatch bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := s.Host(chi.URLParam(r, "name"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown host")
+			return
+		}
+
+		var u hostUpdate
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&u); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "malformed request body")
+			return
+		}
+
+		if u.IPv4 != nil && !u.IPv4.Is4() {
+			writeJSONError(w, http.StatusBadRequest, "ipv4 is incorrect")
+			return
+		}
+		if u.IPv6 != nil && !u.IPv6.Is6() {
+			writeJSONError(w, http.StatusBadRequest, "ipv6 is incorrect")
+			return
+		}
+		if u.IPv4 == nil && u.IPv6 == nil {
+			writeJSONError(w, http.StatusBadRequest, "ipv4 or ipv6 required, use DELETE to remove all records")
+			return
+		}
+		// RFC 2181 limits TTLs to 31 bits; zero would disable caching.
+		if u.TTL != nil && (*u.TTL < 1 || *u.TTL > math.MaxInt32) {
+			writeJSONError(w, http.StatusBadRequest, "ttl is incorrect")
+			return
+		}
+		if requireSourceMatch {
+			addr, err := netip.ParseAddr(remoteHost(r))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "cannot determine client address")
+				return
+			}
+			addr = addr.Unmap()
+
+			submitted, field := u.IPv4, "ipv4"
+			if addr.Is6() {
+				submitted, field = u.IPv6, "ipv6"
+			}
+			if submitted == nil || *submitted != addr {
+				writeJSONError(w, http.StatusBadRequest, field+" does not match client address")
+				return
+			}
+		}
+
+		h.IPv4, h.IPv6 = u.IPv4, u.IPv6
+		h.Client = remoteHost(r)
+		if u.TTL != nil {
+			h.TTL = *u.TTL
+		}
+
+		if _, err := s.Apply(h); err != nil {
+			slog.Error("cannot update zonefile", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "cannot update zonefile")
+			return
+		}
+
+		h, _ = s.Host(h.Name)
+		writeJSON(w, http.StatusOK, h)
+	}
+}
+
+func deleteHostHandler(s *zoneStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		if _, ok := s.Host(name); !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown host")
+			return
+		}
+
+		if err := s.Delete(name); err != nil {
+			slog.Error("cannot update zonefile", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "cannot update zonefile")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiHandler serves the versioned JSON API. It is meant to be mounted at
+// /api/v1 next to updaterHandler.
+func apiHandler(c updaterHandlerConfig, s *zoneStore, access accessRules) http.Handler {
+	route := chi.NewRouter()
+	route.Use(ClientAllowlistMiddleware(access.allowed))
+	route.Use(BasicAuthMiddleware(c.User, access.validate))
+	route.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+	})
+	route.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+	route.Get("/hosts", listHostsHandler(s))
+	route.Get("/hosts/{name}", getHostHandler(s))
+	route.Put("/hosts/{name}", putHostHandler(s, c.RequireSourceMatch))
+	route.Delete("/hosts/{name}", deleteHostHandler(s))
+	return route
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// testUpdaterConfig returns a config for user "dyndns" whose password is
+// "secret-password" (base64url "c2VjcmV0LXBhc3N3b3Jk"), using cheap argon2id
+// parameters so tests stay fast.
+func testUpdaterConfig(t *testing.T) updaterHandlerConfig {
+	t.Helper()
+	salt := []byte("0123456789abcdef")
+	return updaterHandlerConfig{
+		User:          "dyndns",
+		Filename:      filepath.Join(t.TempDir(), "zone.txt"),
+		DomainSubpart: "home",
+		Password: passwordConfig{
+			Key:     argon2.IDKey([]byte("secret-password"), salt, 1, 64, 1, 32),
+			Salt:    salt,
+			Time:    1,
+			Memory:  64,
+			Threads: 1,
+			KeyLen:  32,
+		},
+	}
+}
+
+// testAccessRules returns the access rules of a server with updater config c.
+func testAccessRules(c updaterHandlerConfig) accessRules {
+	return newAccessRules(&serverConfig{UpdaterHandler: c})
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		user, passwd       string
+		setAuth            bool
+		expectedStatusCode int
+		expectValidate     bool
+	}{
+		{"no credentials", "", "", false, 401, false},
+		{"valid", "baz", "LnRlc3Qu", true, 200, true},
+		{"wrong user", "foobar", "LnRlc3Qu", true, 401, true},
+		{"empty user", "", "LnRlc3Qu", true, 401, true},
+		{"invalid base64", "baz", "a+b/", true, 401, false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			validated := false
+			handler := BasicAuthMiddleware("baz", func(origPasswd []byte) bool {
+				validated = true
+				return string(origPasswd) == ".test."
+			})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if testCase.setAuth {
+				req.SetBasicAuth(testCase.user, testCase.passwd)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Result().StatusCode != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v", w.Result().StatusCode, testCase.expectedStatusCode)
+			}
+			if validated != testCase.expectValidate {
+				t.Errorf("validator called=%v, expected=%v", validated, testCase.expectValidate)
+			}
+			if w.Result().StatusCode == http.StatusUnauthorized && w.Result().Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("401 without WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	c := testUpdaterConfig(t)
+	s := newZoneStore(newFileBackend(c.Filename, newZonefile()), c.DomainSubpart)
+	handler := apiHandler(c, s, testAccessRules(c))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("dyndns", "c2VjcmV0LXBhc3N3b3Jk")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, testCase := range []struct {
+		name           string
+		method, path   string
+		body           string
+		expectedStatus int
+		wantInBody     []string
+	}{
+		{"list", "GET", "/hosts", "", 200, []string{`"name":"home"`, `"ipv4":null`}},
+		{"get unknown", "GET", "/hosts/office", "", 404, []string{`"error":"unknown host"`}},
+		{"put unknown", "PUT", "/hosts/office", `{"ipv4":"192.168.1.1"}`, 404, []string{`"error"`}},
+		{"put malformed", "PUT", "/hosts/home", `{"ipv4":`, 400, []string{`"error"`}},
+		{"put unknown field", "PUT", "/hosts/home", `{"ip":"192.168.1.1"}`, 400, []string{`"error"`}},
+		{"put v6 in v4", "PUT", "/hosts/home", `{"ipv4":"2001:db8::1"}`, 400, []string{`"error":"ipv4 is incorrect"`}},
+		{"put zero ttl", "PUT", "/hosts/home", `{"ipv4":"192.168.1.1","ttl":0}`, 400, []string{`"error":"ttl is incorrect"`}},
+		{"put ttl above 31 bits", "PUT", "/hosts/home", `{"ipv4":"192.168.1.1","ttl":2147483648}`, 400, []string{`"error":"ttl is incorrect"`}},
+		{"put ttl above 32 bits", "PUT", "/hosts/home", `{"ipv4":"192.168.1.1","ttl":4294967296}`, 400, []string{`"error":"ttl is incorrect"`}},
+		{"put empty", "PUT", "/hosts/home", `{}`, 400, []string{`"error"`}},
+		{"put", "PUT", "/hosts/home", `{"ipv4":"192.168.1.1","ipv6":"2001:db8::1","ttl":300}`, 200, []string{`"ipv4":"192.168.1.1"`, `"ipv6":"2001:db8::1"`, `"ttl":300`, `"updatedAt"`}},
+		{"get after put", "GET", "/hosts/home", "", 200, []string{`"ipv4":"192.168.1.1"`}},
+		{"method not allowed", "POST", "/hosts/home", "", 405, []string{`"error"`}},
+		{"not found", "GET", "/records", "", 404, []string{`"error"`}},
+		{"delete", "DELETE", "/hosts/home", "", 204, nil},
+		{"get after delete", "GET", "/hosts/home", "", 200, []string{`"ipv4":null`, `"ipv6":null`}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			w := do(testCase.method, testCase.path, testCase.body)
+			if w.Result().StatusCode != testCase.expectedStatus {
+				t.Errorf("status code is %v instead of %v: %s", w.Result().StatusCode, testCase.expectedStatus, w.Body)
+			}
+			if len(testCase.wantInBody) > 0 && w.Result().Header.Get("Content-Type") != "application/json" {
+				t.Errorf("content type is %q instead of application/json", w.Result().Header.Get("Content-Type"))
+			}
+			for _, want := range testCase.wantInBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body is missing %q: %s", want, w.Body)
+				}
+			}
+		})
+	}
+
+	got, err := os.ReadFile(c.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), " IN ") {
+		t.Errorf("zonefile still contains records after delete: %q", got)
+	}
+}
+
+func TestAPIHandler_Unauthorized(t *testing.T) {
+	c := testUpdaterConfig(t)
+	handler := apiHandler(c, newZoneStore(newFileBackend(c.Filename, newZonefile()), c.DomainSubpart), testAccessRules(c))
+
+	req := httptest.NewRequest("GET", "/hosts", nil)
+	req.SetBasicAuth("dyndns", "d3JvbmctcGFzc3dvcmQ")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("status code is %v instead of %v", w.Result().StatusCode, http.StatusUnauthorized)
+	}
+	var body apiError
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error == "" {
+		t.Errorf("expected JSON error body, got %q (%v)", w.Body, err)
+	}
+}
+
+func TestAPIHandler_AllowedClients(t *testing.T) {
+	c := testUpdaterConfig(t)
+	c.AllowedClients = []string{"192.0.2.0/24"}
+	handler := apiHandler(c, newZoneStore(newFileBackend(c.Filename, newZonefile()), c.DomainSubpart), testAccessRules(c))
+
+	for _, testCase := range []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"198.51.100.1:1234", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("PUT", "/hosts/home", strings.NewReader(`{"ipv4": "192.168.1.1"}`))
+		req.RemoteAddr = testCase.remoteAddr
+		req.SetBasicAuth("dyndns", "c2VjcmV0LXBhc3N3b3Jk")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != testCase.expectedStatus {
+			t.Errorf("%s: status code is %v instead of %v", testCase.remoteAddr, w.Result().StatusCode, testCase.expectedStatus)
+		}
+	}
+}
+
+func TestAPIHandler_RequireSourceMatch(t *testing.T) {
+	c := testUpdaterConfig(t)
+	c.RequireSourceMatch = true
+	handler := apiHandler(c, newZoneStore(newFileBackend(c.Filename, newZonefile()), c.DomainSubpart), testAccessRules(c))
+
+	for _, testCase := range []struct {
+		name           string
+		remoteAddr     string
+		body           string
+		expectedStatus int
+		wantInBody     string
+	}{
+		{"ipv4 matches", "192.0.2.1:1234", `{"ipv4":"192.0.2.1","ipv6":"2001:db8::1"}`, http.StatusOK, `"ipv4":"192.0.2.1"`},
+		{"ipv4 differs", "192.0.2.1:1234", `{"ipv4":"198.51.100.1"}`, http.StatusBadRequest, `"error":"ipv4 does not match client address"`},
+		{"ipv4 missing", "192.0.2.1:1234", `{"ipv6":"2001:db8::1"}`, http.StatusBadRequest, `"error":"ipv4 does not match client address"`},
+		{"ipv6 matches", "[2001:db8::1]:1234", `{"ipv6":"2001:db8::1"}`, http.StatusOK, `"ipv6":"2001:db8::1"`},
+		{"ipv6 differs", "[2001:db8::1]:1234", `{"ipv4":"192.0.2.1","ipv6":"2001:db8::2"}`, http.StatusBadRequest, `"error":"ipv6 does not match client address"`},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/hosts/home", strings.NewReader(testCase.body))
+			req.RemoteAddr = testCase.remoteAddr
+			req.SetBasicAuth("dyndns", "c2VjcmV0LXBhc3N3b3Jk")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Result().StatusCode != testCase.expectedStatus {
+				t.Errorf("status code is %v instead of %v: %s", w.Result().StatusCode, testCase.expectedStatus, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), testCase.wantInBody) {
+				t.Errorf("body is missing %q: %s", testCase.wantInBody, w.Body)
+			}
+		})
+	}
+}
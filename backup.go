@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// BACKUP_TIME_FORMAT is appended to the zonefile name of a backup. It sorts
+// lexically and contains no characters that need quoting in a shell.
+const BACKUP_TIME_FORMAT = "20060102T150405.000000000Z"
+
+type zonefileBackup struct {
+	Path    string
+	Version string
+	Time    time.Time
+}
+
+// listBackups returns the backups of filename, newest first.
+func listBackups(filename string) ([]zonefileBackup, error) {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []zonefileBackup{}
+	for _, path := range matches {
+		version := strings.TrimPrefix(path, filename+".")
+		t, err := time.Parse(BACKUP_TIME_FORMAT, version)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, zonefileBackup{Path: path, Version: version, Time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+	return backups, nil
+}
+
+// backupZonefile stores content as a new version of filename and removes
+// all but the newest keep versions.
+func backupZonefile(filename string, content []byte, keep int, now time.Time) error {
+	path := filename + "." + now.UTC().Format(BACKUP_TIME_FORMAT)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("cannot back up zonefile %s: %w", filename, err)
+	}
+
+	backups, err := listBackups(filename)
+	if err != nil {
+		return fmt.Errorf("cannot list backups of zonefile %s: %w", filename, err)
+	}
+	for _, b := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(b.Path); err != nil {
+			return fmt.Errorf("cannot remove backup %s: %w", b.Path, err)
+		}
+	}
+	return nil
+}
+
+// rollbackZonefile replaces filename with the backup of the given version.
+// The replaced content is backed up itself, so a rollback can be undone.
+func rollbackZonefile(filename, version string, keep int) error {
+	backups, err := listBackups(filename)
+	if err != nil {
+		return fmt.Errorf("cannot list backups of zonefile %s: %w", filename, err)
+	}
+	path := ""
+	for _, b := range backups {
+		if b.Version == version {
+			path = b.Path
+		}
+	}
+	if path == "" {
+		return fmt.Errorf("unknown backup version %q of zonefile %s", version, filename)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read backup %s: %w", path, err)
+	}
+	if current, err := os.ReadFile(filename); err == nil && len(current) > 0 {
+		// Pruning here could remove the versions the user wants next.
+		if err := backupZonefile(filename, current, max(keep, len(backups)+1), time.Now()); err != nil {
+			return err
+		}
+	}
+	return writeZonefile(filename, content)
+}
+
+// parseManagedRecords reads the A and AAAA records of subpart written by
+// mergeZonefile. Without markers the whole content is searched.
+func parseManagedRecords(content []byte, subpart string) subdomain {
+	s := subdomain{Subpart: subpart}
+
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == ZONEFILE_BEGIN_MARKER {
+			lines = lines[i+1:]
+			break
+		}
+	}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == ZONEFILE_END_MARKER {
+			break
+		}
+		if !isAddressRecordOf(line, subpart) {
+			continue
+		}
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		addr, err := netip.ParseAddr(fields[len(fields)-1])
+		if err != nil {
+			continue
+		}
+		for _, f := range fields[1 : len(fields)-1] {
+			if ttl, err := strconv.ParseUint(f, 10, 32); err == nil {
+				s.TTL = uint(ttl)
+			}
+		}
+		if addr.Is4() {
+			s.IPv4 = &addr
+		} else {
+			s.IPv6 = &addr
+		}
+	}
+	return s
+}
+
+// Load returns the records of name as found in the zonefile.
+func (b *fileBackend) Load(name string) (subdomain, error) {
+	content, err := os.ReadFile(b.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return subdomain{Subpart: name}, nil
+	}
+	if err != nil {
+		return subdomain{}, fmt.Errorf("cannot read zonefile %s: %w", b.filename, err)
+	}
+	return parseManagedRecords(content, name), nil
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [version]",
+	Short: "list zonefile backups or restore one of them",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadServerConfig()
+		if err != nil {
+			return err
+		}
+		filename := config.UpdaterHandler.Filename
+		if filename == "" {
+			return fmt.Errorf("undefined filename for zonefile")
+		}
+
+		if len(args) == 0 {
+			backups, err := listBackups(filename)
+			if err != nil {
+				return err
+			}
+			for _, b := range backups {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", b.Version, b.Time.Local().Format(time.RFC3339))
+			}
+			return nil
+		}
+
+		if err := rollbackZonefile(filename, args[0], config.UpdaterHandler.Backups); err != nil {
+			return err
+		}
+
+		store := newZoneStore(newFileBackend(filename, newZonefile()), config.UpdaterHandler.DomainSubpart)
+		if err := store.Sync(); err != nil {
+			return err
+		}
+		for _, h := range store.Hosts() {
+			fmt.Fprintf(cmd.OutOrStdout(), "restored %s: ipv4=%s ipv6=%s ttl=%d\n", h.Name, addrString(h.IPv4), addrString(h.IPv6), h.TTL)
+		}
+		fmt.Fprintln(cmd.ErrOrStderr(), "send SIGHUP to a running server to read the restored zonefile")
+		return nil
+	},
+}
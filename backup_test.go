@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupZonefile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone.txt")
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	for i := range 4 {
+		if err := backupZonefile(path, []byte{byte('a' + i)}, 3, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := listBackups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("kept %d backups instead of 3: %+v", len(backups), backups)
+	}
+	if backups[0].Version != "20261019T120003.000000000Z" || !backups[0].Time.Equal(now.Add(3*time.Second)) {
+		t.Errorf("newest backup is %+v", backups[0])
+	}
+	got, err := os.ReadFile(backups[2].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "b" {
+		t.Errorf("oldest kept backup contains %q instead of %q", got, "b")
+	}
+
+	// Unrelated files next to the zonefile are neither listed nor removed.
+	other := path + ".orig"
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupZonefile(path, []byte("e"), 1, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file was removed: %v", err)
+	}
+}
+
+func TestFileBackend_Backups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone.txt")
+	b := newFileBackend(path, newZonefile())
+	b.backups = 2
+
+	for _, addr := range []string{"192.168.1.1", "192.168.1.2", "192.168.1.2", "192.168.1.3", "192.168.1.4"} {
+		ipv4 := netip.MustParseAddr(addr)
+		if _, err := b.Publish(subdomain{"home", 60, &ipv4, nil}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := listBackups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("kept %d backups instead of 2", len(backups))
+	}
+	for i, want := range []string{"192.168.1.3", "192.168.1.2"} {
+		content, err := os.ReadFile(backups[i].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := parseManagedRecords(content, "home"); s.IPv4 == nil || s.IPv4.String() != want {
+			t.Errorf("backup %d contains %v instead of %s", i, s.IPv4, want)
+		}
+	}
+}
+
+func TestRollbackZonefile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone.txt")
+	b := newFileBackend(path, newZonefile())
+	b.backups = 5
+
+	for _, addr := range []string{"192.168.1.1", "192.168.1.2"} {
+		ipv4 := netip.MustParseAddr(addr)
+		if _, err := b.Publish(subdomain{"home", 60, &ipv4, nil}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := listBackups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %+v", backups)
+	}
+
+	if err := rollbackZonefile(path, "20000101T000000.000000000Z", 5); err == nil {
+		t.Errorf("expected error for unknown version")
+	}
+	if err := rollbackZonefile(path, backups[0].Version, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newZoneStore(b, "home")
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := s.Host("home")
+	if h.IPv4 == nil || h.IPv4.String() != "192.168.1.1" || h.TTL != 60 {
+		t.Errorf("store was not re-synced with the restored zonefile: %+v", h)
+	}
+
+	// The replaced version is kept, so the rollback can be undone.
+	if backups, _ := listBackups(path); len(backups) != 2 {
+		t.Errorf("expected the replaced version as second backup, got %+v", backups)
+	}
+}
+
+func TestParseManagedRecords(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		content  string
+		expected subdomain
+	}{
+		{"empty", "", subdomain{Subpart: "home"}},
+		{
+			"markers",
+			"home.{DOM_HOSTNAME}. 60 IN A 10.0.0.1\n" + ZONEFILE_BEGIN_MARKER + "\n{DEFAULT_ZONEFILE}\nhome.{DOM_HOSTNAME}. 120 IN A 192.168.1.1\nhome.{DOM_HOSTNAME}. 120 IN AAAA 2001:db8::1\n" + ZONEFILE_END_MARKER + "\n",
+			subdomain{"home", 120, ptr(netip.MustParseAddr("192.168.1.1")), ptr(netip.MustParseAddr("2001:db8::1"))},
+		},
+		{
+			"without markers",
+			"{DEFAULT_ZONEFILE}\nhome 300 IN AAAA 2001:db8::1 ; router\nwww IN A 10.0.0.1\n",
+			subdomain{"home", 300, nil, ptr(netip.MustParseAddr("2001:db8::1"))},
+		},
+	} {
+		got := parseManagedRecords([]byte(testCase.content), "home")
+		if !got.equal(testCase.expected) {
+			t.Errorf("%s: parsed %+v instead of %+v", testCase.name, got, testCase.expected)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sebatec-eu/config-mate/hostsharing"
+	"github.com/spf13/cobra"
+)
+
+type clientConfig struct {
+	// URL of the updater, e.g. https://dyndns.example.com/
+	URL      string
+	User     string
+	Password string
+	// Host and Secret sign updates instead of sending the password. Host
+	// is the DomainSubpart of the updater.
+	Host   string
+	Secret []byte
+	// Interface is searched for public addresses first.
+	Interface string
+	// EchoURL answers with the address of the caller in plain text, like
+	// the /ip endpoint. It is called once via IPv4 and once via IPv6.
+	EchoURL string
+	IPv4    bool
+	IPv6    bool
+	// Interval between address checks. Unchanged addresses are sent again
+	// after Refresh, so the watchdog of the updater does not fire.
+	Interval time.Duration
+	Refresh  time.Duration
+	Timeout  time.Duration
+	Retries  int
+	Backoff  time.Duration
+}
+
+func loadClientConfig() (*clientConfig, error) {
+	c := struct{ Client clientConfig }{
+		Client: clientConfig{
+			IPv4:     true,
+			IPv6:     true,
+			Interval: 5 * time.Minute,
+			Refresh:  24 * time.Hour,
+			Timeout:  10 * time.Second,
+			Retries:  3,
+			Backoff:  10 * time.Second,
+		},
+	}
+
+	if err := hostsharing.ReadInConfig(&c, "hostsharing-dyndns",
+		base64StringToBytesHookFunc(),
+		mapstructure.StringToTimeDurationHookFunc(),
+	); err != nil {
+		return nil, fmt.Errorf("fatal error config file: %w", err)
+	}
+
+	validationErrors := []error{}
+	if c.Client.URL == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined updater url"))
+	}
+	if len(c.Client.Secret) > 0 {
+		if c.Client.Host == "" {
+			validationErrors = append(validationErrors, fmt.Errorf("undefined host for signed updates"))
+		}
+	} else if c.Client.User == "" || c.Client.Password == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined user or password"))
+	}
+	if !c.Client.IPv4 && !c.Client.IPv6 {
+		validationErrors = append(validationErrors, fmt.Errorf("neither ipv4 nor ipv6 enabled"))
+	}
+	if c.Client.Interface == "" && c.Client.EchoURL == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined interface or echo url"))
+	}
+
+	if len(validationErrors) > 0 {
+		return nil, fmt.Errorf("missing required configuration: \n\n%s", errors.Join(validationErrors...))
+	}
+	return &c.Client, nil
+}
+
+// updateClient keeps a name current by sending the public addresses of this
+// machine to the updater.
+type updateClient struct {
+	c              clientConfig
+	client         *http.Client
+	echo4, echo6   *http.Client
+	interfaceAddrs func(name string) ([]net.Addr, error)
+	now            func() time.Time
+	sleep          func(ctx context.Context, d time.Duration) error
+
+	lastIPv4, lastIPv6 *netip.Addr
+	lastSent           time.Time
+}
+
+func newUpdateClient(c clientConfig) *updateClient {
+	return &updateClient{
+		c:              c,
+		client:         &http.Client{Timeout: c.Timeout},
+		echo4:          familyClient("tcp4", c.Timeout),
+		echo6:          familyClient("tcp6", c.Timeout),
+		interfaceAddrs: interfaceAddrs,
+		now:            time.Now,
+		sleep:          sleepContext,
+	}
+}
+
+// familyClient connects via network only, so an echo service sees the
+// address of the requested family.
+func familyClient(network string, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func interfaceAddrs(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// sharedAddressSpace is used for carrier-grade NAT and not reachable from
+// the internet.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddrs returns the first public IPv4 and IPv6 address of addrs.
+func publicAddrs(addrs []net.Addr) (ipv4, ipv6 *netip.Addr) {
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr) {
+			continue
+		}
+		if addr.Is4() && ipv4 == nil {
+			ipv4 = &addr
+		}
+		if addr.Is6() && ipv6 == nil {
+			ipv6 = &addr
+		}
+	}
+	return ipv4, ipv6
+}
+
+func (u *updateClient) echo(ctx context.Context, client *http.Client) (netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.c.EchoURL, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("echo url responded with %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(strings.TrimSpace(string(body)))
+}
+
+// discover returns the public addresses of all enabled families. It fails
+// if one of them cannot be found, as sending only the other one would
+// remove its record.
+func (u *updateClient) discover(ctx context.Context) (ipv4, ipv6 *netip.Addr, err error) {
+	if u.c.Interface != "" {
+		addrs, err := u.interfaceAddrs(u.c.Interface)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read addresses of %s: %w", u.c.Interface, err)
+		}
+		ipv4, ipv6 = publicAddrs(addrs)
+	}
+
+	if u.c.EchoURL != "" {
+		if u.c.IPv4 && ipv4 == nil {
+			addr, err := u.echo(ctx, u.echo4)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot discover ipv4 address: %w", err)
+			}
+			if !addr.Is4() {
+				return nil, nil, fmt.Errorf("echo url returned %s instead of an ipv4 address", addr)
+			}
+			ipv4 = &addr
+		}
+		if u.c.IPv6 && ipv6 == nil {
+			addr, err := u.echo(ctx, u.echo6)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot discover ipv6 address: %w", err)
+			}
+			if !addr.Is6() || addr.Is4In6() {
+				return nil, nil, fmt.Errorf("echo url returned %s instead of an ipv6 address", addr)
+			}
+			ipv6 = &addr
+		}
+	}
+
+	if !u.c.IPv4 {
+		ipv4 = nil
+	}
+	if !u.c.IPv6 {
+		ipv6 = nil
+	}
+	if u.c.IPv4 && ipv4 == nil {
+		return nil, nil, fmt.Errorf("no public ipv4 address found")
+	}
+	if u.c.IPv6 && ipv6 == nil {
+		return nil, nil, fmt.Errorf("no public ipv6 address found")
+	}
+	return ipv4, ipv6, nil
+}
+
+// errPermanent marks updater responses that are not worth retrying.
+var errPermanent = errors.New("permanent failure")
+
+func (u *updateClient) send(ctx context.Context, ipv4, ipv6 *netip.Addr) error {
+	q := url.Values{}
+	if ipv4 != nil {
+		q.Set("ipaddr", ipv4.String())
+	}
+	if ipv6 != nil {
+		q.Set("ip6addr", ipv6.String())
+	}
+	if len(u.c.Secret) > 0 {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		q.Set("host", u.c.Host)
+		q.Set("ts", strconv.FormatInt(u.now().Unix(), 10))
+		q.Set("nonce", base64.RawURLEncoding.EncodeToString(nonce))
+		q.Set("sig", signQuery(u.c.Secret, q))
+	} else {
+		q.Set("user", u.c.User)
+		q.Set("passwd", u.c.Password)
+	}
+
+	target, err := url.Parse(u.c.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	target.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%w: updater responded with %s: %s", errPermanent, resp.Status, strings.TrimSpace(string(body)))
+	default:
+		return fmt.Errorf("updater responded with %s", resp.Status)
+	}
+}
+
+// update sends the addresses and retries with exponential backoff unless
+// the updater rejected the request itself.
+func (u *updateClient) update(ctx context.Context, ipv4, ipv6 *netip.Addr) error {
+	backoff := u.c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := u.send(ctx, ipv4, ipv6)
+		if err == nil || errors.Is(err, errPermanent) || attempt >= u.c.Retries {
+			return err
+		}
+		slog.Warn("cannot update, retrying", "backoff", backoff, "err", err)
+		if err := u.sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// RunOnce discovers the addresses and sends them if they changed since the
+// last successful update or Refresh has passed.
+func (u *updateClient) RunOnce(ctx context.Context) error {
+	ipv4, ipv6, err := u.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !u.lastSent.IsZero() && sameAddr(ipv4, u.lastIPv4) && sameAddr(ipv6, u.lastIPv6) && u.now().Sub(u.lastSent) < u.c.Refresh {
+		slog.Debug("addresses unchanged", "ipv4", addrString(ipv4), "ipv6", addrString(ipv6))
+		return nil
+	}
+
+	if err := u.update(ctx, ipv4, ipv6); err != nil {
+		return err
+	}
+	slog.Info("updated addresses", "ipv4", addrString(ipv4), "ipv6", addrString(ipv6))
+	u.lastIPv4, u.lastIPv6, u.lastSent = ipv4, ipv6, u.now()
+	return nil
+}
+
+// Run calls RunOnce every interval until ctx is done.
+func (u *updateClient) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := u.RunOnce(ctx); err != nil {
+			slog.Error("cannot update addresses", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var clientOnce bool
+
+func init() {
+	clientCmd.Flags().BoolVar(&clientOnce, "once", false, "update once and exit")
+}
+
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "keep a name current by sending the public addresses of this machine to the updater",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+
+		u := newUpdateClient(*config)
+		if clientOnce {
+			return u.RunOnce(cmd.Context())
+		}
+		u.Run(cmd.Context(), config.Interval)
+		return nil
+	},
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublicAddrs(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1")},
+		&net.IPNet{IP: net.ParseIP("192.168.178.2")},
+		&net.IPNet{IP: net.ParseIP("100.64.1.2")},
+		&net.IPNet{IP: net.ParseIP("fe80::1")},
+		&net.IPNet{IP: net.ParseIP("fd00::1")},
+		&net.IPNet{IP: net.ParseIP("203.0.113.7")},
+		&net.IPNet{IP: net.ParseIP("2001:db8::7")},
+		&net.IPNet{IP: net.ParseIP("2001:db8::8")},
+	}
+	ipv4, ipv6 := publicAddrs(addrs)
+	if addrString(ipv4) != "203.0.113.7" || addrString(ipv6) != "2001:db8::7" {
+		t.Errorf("public addresses are %v and %v", ipv4, ipv6)
+	}
+
+	if ipv4, ipv6 := publicAddrs(addrs[:5]); ipv4 != nil || ipv6 != nil {
+		t.Errorf("expected no public addresses, got %v and %v", ipv4, ipv6)
+	}
+}
+
+// updaterServer records the query of every request and answers with the
+// next status from statuses, or 200 once they are used up.
+func updaterServer(t *testing.T, statuses ...int) (*httptest.Server, func() []url.Values) {
+	t.Helper()
+	var mu sync.Mutex
+	queries := []url.Values{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, r.URL.Query())
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+			return
+		}
+		w.Write([]byte("Ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]url.Values{}, queries...)
+	}
+}
+
+func TestUpdateClient_RunOnce(t *testing.T) {
+	updater, queries := updaterServer(t)
+	echoAddr := "203.0.113.7"
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(echoAddr + "\n"))
+	}))
+	defer echo.Close()
+
+	u := newUpdateClient(clientConfig{
+		URL:       updater.URL + "/",
+		User:      "dyndns",
+		Password:  "c2VjcmV0LXBhc3N3b3Jk",
+		Interface: "eth0",
+		EchoURL:   echo.URL,
+		IPv4:      true,
+		IPv6:      true,
+		Refresh:   time.Hour,
+	})
+	u.interfaceAddrs = func(name string) ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("192.168.178.2")},
+			&net.IPNet{IP: net.ParseIP("2001:db8::7")},
+		}, nil
+	}
+	now := time.Now()
+	u.now = func() time.Time { return now }
+
+	expectQueries := func(t *testing.T, n int) {
+		t.Helper()
+		if got := queries(); len(got) != n {
+			t.Fatalf("updater was called %d times instead of %d", len(got), n)
+		}
+	}
+
+	if err := u.RunOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectQueries(t, 1)
+	q := queries()[0]
+	for key, want := range map[string]string{"user": "dyndns", "passwd": "c2VjcmV0LXBhc3N3b3Jk", "ipaddr": "203.0.113.7", "ip6addr": "2001:db8::7"} {
+		if q.Get(key) != want {
+			t.Errorf("%s is %q instead of %q", key, q.Get(key), want)
+		}
+	}
+
+	// Unchanged addresses are not sent again before Refresh passed.
+	if err := u.RunOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectQueries(t, 1)
+
+	now = now.Add(2 * time.Hour)
+	if err := u.RunOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectQueries(t, 2)
+
+	echoAddr = "203.0.113.8"
+	if err := u.RunOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectQueries(t, 3)
+	if got := queries()[2].Get("ipaddr"); got != "203.0.113.8" {
+		t.Errorf("ipaddr is %q instead of the changed address", got)
+	}
+}
+
+func TestUpdateClient_Discover(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("2001:db8::7"))
+	}))
+	defer echo.Close()
+
+	for _, testCase := range []struct {
+		name        string
+		c           clientConfig
+		expectedErr string
+	}{
+		{"echo only v4", clientConfig{EchoURL: echo.URL, IPv4: true}, "instead of an ipv4 address"},
+		{"missing v6", clientConfig{Interface: "eth0", IPv4: true, IPv6: true}, "no public ipv6 address found"},
+		{"v4 only", clientConfig{Interface: "eth0", IPv4: true}, ""},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			u := newUpdateClient(testCase.c)
+			u.echo4 = echo.Client()
+			u.interfaceAddrs = func(name string) ([]net.Addr, error) {
+				return []net.Addr{&net.IPNet{IP: net.ParseIP("203.0.113.7")}}, nil
+			}
+
+			ipv4, ipv6, err := u.discover(context.Background())
+			if testCase.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if addrString(ipv4) != "203.0.113.7" || ipv6 != nil {
+					t.Errorf("discovered %v and %v", ipv4, ipv6)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+				t.Errorf("error is %v instead of %q", err, testCase.expectedErr)
+			}
+		})
+	}
+}
+
+func TestUpdateClient_Retries(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		statuses         []int
+		expectedAttempts int
+		expectedErr      bool
+	}{
+		{"succeeds after retries", []int{500, 502}, 3, false},
+		{"gives up", []int{500, 500, 500, 500}, 4, true},
+		{"wrong password", []int{401}, 1, true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			updater, queries := updaterServer(t, testCase.statuses...)
+			u := newUpdateClient(clientConfig{URL: updater.URL, User: "dyndns", Password: "x", IPv4: true, Retries: 3, Backoff: time.Second})
+			var backoffs []time.Duration
+			u.sleep = func(ctx context.Context, d time.Duration) error {
+				backoffs = append(backoffs, d)
+				return nil
+			}
+
+			ipv4 := netip.MustParseAddr("203.0.113.7")
+			err := u.update(context.Background(), &ipv4, nil)
+			if (err != nil) != testCase.expectedErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if got := len(queries()); got != testCase.expectedAttempts {
+				t.Errorf("updater was called %d times instead of %d", got, testCase.expectedAttempts)
+			}
+			for i, b := range backoffs {
+				if b != time.Second<<i {
+					t.Errorf("backoffs are %v", backoffs)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadClientConfig(t *testing.T) {
+	valid := `
+Client:
+  URL: https://dyndns.example.com/
+  User: dyndns
+  Password: c2VjcmV0LXBhc3N3b3Jk
+  EchoURL: https://dyndns.example.com/ip
+  IPv6: false
+  Interval: 1m
+`
+
+	for _, testCase := range []struct {
+		name       string
+		yaml       string
+		wantErrSub []string
+	}{
+		{"valid", valid, nil},
+		{"missing url", strings.Replace(valid, "  URL: https://dyndns.example.com/\n", "", 1), []string{"undefined updater url"}},
+		{"missing password", strings.Replace(valid, "  Password: c2VjcmV0LXBhc3N3b3Jk\n", "", 1), []string{"undefined user or password"}},
+		{"signed without host", strings.Replace(valid, "  Password: c2VjcmV0LXBhc3N3b3Jk\n", "  Secret: MDEyMzQ1Njc4OWFiY2RlZg==\n", 1), []string{"undefined host for signed updates"}},
+		{"missing source", strings.Replace(valid, "  EchoURL: https://dyndns.example.com/ip\n", "", 1), []string{"undefined interface or echo url"}},
+		{"no family", strings.Replace(valid, "  IPv6: false", "  IPv6: false\n  IPv4: false", 1), []string{"neither ipv4 nor ipv6 enabled"}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			defer chdirTempConfig(t, testCase.yaml)()
+
+			c, err := loadClientConfig()
+			if testCase.wantErrSub == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !c.IPv4 || c.IPv6 || c.Interval != time.Minute || c.Refresh != 24*time.Hour || c.Retries != 3 {
+					t.Errorf("unexpected config %+v", c)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			for _, want := range testCase.wantErrSub {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q is missing %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type ctxClientAddrKey struct{}
+
+// parsePrefixes parses CIDR prefixes. A single address is taken as a prefix
+// covering only itself.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, v := range values {
+		if p, err := netip.ParsePrefix(v); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or prefix %q", v)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client. If the request comes from
+// one of the trusted proxies, X-Forwarded-For is followed from the right up
+// to the first address that is not a trusted proxy itself.
+func clientAddr(r *http.Request, trusted []netip.Prefix) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+	addr = addr.Unmap()
+
+	if !containsAddr(trusted, addr) {
+		return addr, nil
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// Anything left of a broken entry may be forged.
+			return addr, nil
+		}
+		addr = hop.Unmap()
+		if !containsAddr(trusted, addr) {
+			return addr, nil
+		}
+	}
+	return addr, nil
+}
+
+// ClientAddrMiddleware resolves the client address once per request, so
+// every handler sees the same address behind trusted proxies.
+func ClientAddrMiddleware(trusted []netip.Prefix) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if addr, err := clientAddr(r, trusted); err == nil {
+				r = r.WithContext(context.WithValue(r.Context(), ctxClientAddrKey{}, addr))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"10.1.2.3/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"} {
+		if prefixes[i].String() != want {
+			t.Errorf("prefix %d is %s instead of %s", i, prefixes[i], want)
+		}
+	}
+
+	if _, err := parsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("expected error for invalid prefix")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		expectedAddr  string
+		expectedError bool
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7", false},
+		{"untrusted proxy", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7", false},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1", false},
+		{"forged entry left of the client", "10.0.0.1:1234", []string{"192.0.2.66, 198.51.100.1"}, "198.51.100.1", false},
+		{"proxy chain", "[::1]:1234", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1", false},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2", false},
+		{"broken entry", "10.0.0.1:1234", []string{"unknown"}, "10.0.0.1", false},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1", false},
+		{"mapped ipv4", "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7", false},
+		{"without port", "203.0.113.7", nil, "203.0.113.7", false},
+		{"invalid", "pipe", nil, "", true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = testCase.remoteAddr
+		for _, v := range testCase.forwardedFor {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+
+		addr, err := clientAddr(r, trusted)
+		if testCase.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected error", testCase.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testCase.name, err)
+			continue
+		}
+		if addr != netip.MustParseAddr(testCase.expectedAddr) {
+			t.Errorf("%s: client address is %s instead of %s", testCase.name, addr, testCase.expectedAddr)
+		}
+	}
+}
+
+func TestClientAddrMiddleware(t *testing.T) {
+	trusted, _ := parsePrefixes([]string{"10.0.0.0/8"})
+	var got string
+	handler := ClientAddrMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = remoteHost(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "198.51.100.1" {
+		t.Errorf("remote host is %q instead of the forwarded client", got)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+type dnsServerConfig struct {
+	// Listen is the address the responder serves on via UDP and TCP.
+	Listen string
+	// Zone is the zone the host names are relative to, e.g. dyndns.example.com.
+	Zone string
+	// NS are the name servers of Zone; the first one is used in the SOA record.
+	NS []string
+	// Mbox is the contact address of the SOA record. It defaults to
+	// hostmaster.<Zone>.
+	Mbox string
+	// TTL of the SOA, NS and TXT records.
+	TTL uint
+	// TXT maps names relative to Zone ("@" for the apex) to TXT records.
+	TXT map[string][]string
+}
+
+func (c dnsServerConfig) validate() error {
+	validationErrors := []error{}
+	if c.Zone == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined zone for dns server"))
+	}
+	if len(c.NS) == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined name servers for dns server"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// memoryBackend publishes nothing. It is used when the records are served
+// from the store by the dnsResponder. The records are kept in stateFile, if
+// set, so they are answered again after a restart.
+type memoryBackend struct {
+	stateFile string
+	published map[string]subdomain
+}
+
+func newMemoryBackend(stateFile string) (*memoryBackend, error) {
+	b := &memoryBackend{stateFile: stateFile, published: map[string]subdomain{}}
+	if stateFile == "" {
+		return b, nil
+	}
+
+	content, err := os.ReadFile(stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read state file %s: %w", stateFile, err)
+	}
+	if err := json.Unmarshal(content, &b.published); err != nil {
+		return nil, fmt.Errorf("cannot parse state file %s: %w", stateFile, err)
+	}
+	return b, nil
+}
+
+func (b *memoryBackend) Publish(s subdomain) (bool, error) {
+	if prev, ok := b.published[s.Subpart]; ok && prev.equal(s) {
+		return false, nil
+	}
+
+	published := maps.Clone(b.published)
+	published[s.Subpart] = s
+	if b.stateFile != "" {
+		content, err := json.Marshal(published)
+		if err != nil {
+			return false, err
+		}
+		if err := writeFileAtomic(b.stateFile, content, 0o600); err != nil {
+			return false, fmt.Errorf("cannot write state file %s: %w", b.stateFile, err)
+		}
+	}
+	b.published = published
+	return true, nil
+}
+
+func (b *memoryBackend) Load(name string) (subdomain, error) {
+	if s, ok := b.published[name]; ok {
+		return s, nil
+	}
+	return subdomain{Subpart: name}, nil
+}
+
+// dnsResponder answers queries for the hosts of a zoneStore authoritatively.
+type dnsResponder struct {
+	store   *zoneStore
+	zone    string
+	ns      []string
+	mbox    string
+	ttl     uint32
+	txt     map[string][]string
+	started time.Time
+}
+
+func newDNSResponder(c dnsServerConfig, s *zoneStore) *dnsResponder {
+	zone := dns.CanonicalName(c.Zone)
+	mbox := c.Mbox
+	if mbox == "" {
+		mbox = "hostmaster." + zone
+	}
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+
+	ns := []string{}
+	for _, n := range c.NS {
+		ns = append(ns, dns.Fqdn(n))
+	}
+	txt := map[string][]string{}
+	for name, records := range c.TXT {
+		txt[strings.ToLower(name)] = records
+	}
+
+	return &dnsResponder{
+		store:   s,
+		zone:    zone,
+		ns:      ns,
+		mbox:    dns.Fqdn(strings.Replace(mbox, "@", ".", 1)),
+		ttl:     uint32(ttl),
+		txt:     txt,
+		started: time.Now(),
+	}
+}
+
+// serial is the time of the last update, so secondaries see every change.
+func (d *dnsResponder) serial() uint32 {
+	last := d.started
+	for _, h := range d.store.Hosts() {
+		if h.UpdatedAt.After(last) {
+			last = h.UpdatedAt
+		}
+	}
+	return uint32(last.Unix())
+}
+
+func (d *dnsResponder) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: d.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: d.ttl},
+		Ns:      d.ns[0],
+		Mbox:    d.mbox,
+		Serial:  d.serial(),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// records returns all records of name and whether name exists in the zone.
+func (d *dnsResponder) records(name string) ([]dns.RR, bool) {
+	rrs := []dns.RR{}
+	label := "@"
+	if name != d.zone {
+		label = strings.TrimSuffix(name, "."+d.zone)
+	}
+
+	if label == "@" {
+		rrs = append(rrs, d.soa())
+		for _, ns := range d.ns {
+			rrs = append(rrs, &dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: d.ttl}, Ns: ns})
+		}
+	}
+
+	exists := label == "@"
+	for _, h := range d.store.Hosts() {
+		if !strings.EqualFold(h.Name, label) {
+			continue
+		}
+		exists = true
+		if h.IPv4 != nil {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(h.TTL)},
+				A:   net.IP(h.IPv4.AsSlice()),
+			})
+		}
+		if h.IPv6 != nil {
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(h.TTL)},
+				AAAA: net.IP(h.IPv6.AsSlice()),
+			})
+		}
+	}
+
+	if txt, ok := d.txt[label]; ok {
+		exists = true
+		rrs = append(rrs, &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: d.ttl}, Txt: txt})
+	}
+	return rrs, exists
+}
+
+func (d *dnsResponder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		m.Rcode = dns.RcodeNotImplemented
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	if !dns.IsSubDomain(d.zone, name) {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	rrs, exists := d.records(name)
+	for _, rr := range rrs {
+		rr.Header().Name = q.Name
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, d.soa())
+	}
+	w.WriteMsg(m)
+}
+
+var serveDNSCmd = &cobra.Command{
+	Use:   "serveDNS",
+	Short: "serve the managed names via DNS instead of writing a zonefile",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadServerConfig()
+		if err != nil {
+			return err
+		}
+		if err := applyListenFlags(cmd, &config.Listen); err != nil {
+			return err
+		}
+		if err := config.DNS.validate(); err != nil {
+			return err
+		}
+		// serveDNS does not reload its configuration, but SIGHUP would
+		// otherwise terminate it.
+		signal.Ignore(syscall.SIGHUP)
+
+		setup, err := setupServer(cmd.Context(), config, newServerState())
+		if err != nil {
+			return err
+		}
+
+		responder := newDNSResponder(config.DNS, setup.store)
+		errs := make(chan error, 4)
+		if err := startMTLS(cmd.Context(), config, setup.requests.Middleware(setup.mtls), errs); err != nil {
+			return err
+		}
+		for _, proto := range []string{"udp", "tcp"} {
+			server := &dns.Server{Addr: config.DNS.Listen, Net: proto, Handler: responder}
+			go func() {
+				slog.Info("dns server listening", "addr", server.Addr, "net", server.Net)
+				errs <- server.ListenAndServe()
+			}()
+		}
+		go func() {
+			errs <- listenAndServe(cmd.Context(), config.Listen, setup.requests.Middleware(setup.handler))
+		}()
+
+		return waitForShutdown(cmd.Context(), errs, setup.shutdown, config.Listen.ShutdownTimeout)
+	},
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsResponderServer serves d on a random UDP port and returns its address.
+func dnsResponderServer(t *testing.T, d *dnsResponder) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: d, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func TestDNSResponder(t *testing.T) {
+	s := newZoneStore(testMemoryBackend(t, ""), "home", "office")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4, IPv6: &ipv6}); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := dnsResponderServer(t, newDNSResponder(dnsServerConfig{
+		Zone: "dyndns.example.com",
+		NS:   []string{"ns1.example.com", "ns2.example.com"},
+		TXT:  map[string][]string{"@": {"v=spf1 -all"}, "home": {"hello"}},
+	}, s))
+
+	for _, testCase := range []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		expectedRcode int
+		expected      []string
+	}{
+		{"a", "home.dyndns.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"home.dyndns.example.com.\t60\tIN\tA\t192.168.1.1"}},
+		{"aaaa", "home.dyndns.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"home.dyndns.example.com.\t60\tIN\tAAAA\t2001:db8::1"}},
+		{"case insensitive", "HOME.dyndns.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"HOME.dyndns.example.com.\t60\tIN\tA\t192.168.1.1"}},
+		{"txt", "home.dyndns.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"home.dyndns.example.com.\t3600\tIN\tTXT\t\"hello\""}},
+		{"apex txt", "dyndns.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"dyndns.example.com.\t3600\tIN\tTXT\t\"v=spf1 -all\""}},
+		{"ns", "dyndns.example.com.", dns.TypeNS, dns.RcodeSuccess, []string{
+			"dyndns.example.com.\t3600\tIN\tNS\tns1.example.com.",
+			"dyndns.example.com.\t3600\tIN\tNS\tns2.example.com.",
+		}},
+		{"soa", "dyndns.example.com.", dns.TypeSOA, dns.RcodeSuccess, []string{"dyndns.example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.dyndns.example.com."}},
+		{"no data", "office.dyndns.example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"unknown name", "other.dyndns.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		{"other zone", "example.org.", dns.TypeA, dns.RcodeRefused, nil},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(testCase.qname, testCase.qtype)
+			resp, err := dns.Exchange(m, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Rcode != testCase.expectedRcode {
+				t.Errorf("rcode is %s instead of %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[testCase.expectedRcode])
+			}
+			if testCase.expectedRcode != dns.RcodeRefused && !resp.Authoritative {
+				t.Errorf("answer is not authoritative")
+			}
+			if len(resp.Answer) != len(testCase.expected) {
+				t.Fatalf("answer is %v instead of %v", resp.Answer, testCase.expected)
+			}
+			for i := range resp.Answer {
+				if !strings.HasPrefix(resp.Answer[i].String(), testCase.expected[i]) {
+					t.Errorf("answer is %q instead of %q", resp.Answer[i].String(), testCase.expected[i])
+				}
+			}
+			if len(resp.Answer) == 0 && testCase.expectedRcode != dns.RcodeRefused {
+				if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+					t.Errorf("negative answer without SOA: %v", resp.Ns)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSResponder_Serial(t *testing.T) {
+	s := newZoneStore(testMemoryBackend(t, ""), "home")
+	d := newDNSResponder(dnsServerConfig{Zone: "dyndns.example.com", NS: []string{"ns1.example.com"}}, s)
+
+	before := d.serial()
+	if before != uint32(d.started.Unix()) {
+		t.Errorf("serial is %v instead of the start time %v", before, d.started.Unix())
+	}
+
+	d.started = d.started.Add(-time.Hour)
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := s.Host("home")
+	if got := d.serial(); got != uint32(h.UpdatedAt.Unix()) {
+		t.Errorf("serial is %v instead of the last update %v", got, h.UpdatedAt.Unix())
+	}
+}
+
+func testMemoryBackend(t *testing.T, stateFile string) *memoryBackend {
+	t.Helper()
+	b, err := newMemoryBackend(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMemoryBackend(t *testing.T) {
+	b := testMemoryBackend(t, "")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+
+	for _, expected := range []bool{true, false} {
+		changed, err := b.Publish(subdomain{"home", 60, &ipv4, nil})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("changed is %v instead of %v", changed, expected)
+		}
+	}
+}
+
+func TestMemoryBackend_StateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := testMemoryBackend(t, stateFile).Publish(subdomain{"home", 120, &ipv4, nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted server answers with the records published before.
+	s := newZoneStore(testMemoryBackend(t, stateFile), "home")
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := s.Host("home")
+	if h.IPv4 == nil || *h.IPv4 != ipv4 || h.TTL != 120 {
+		t.Errorf("state was not loaded from the state file: %+v", h)
+	}
+
+	if err := os.WriteFile(stateFile, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newMemoryBackend(stateFile); err == nil || !strings.Contains(err.Error(), "cannot parse state file") {
+		t.Errorf("error is %v for a broken state file", err)
+	}
+
+	b := testMemoryBackend(t, filepath.Join(t.TempDir(), "missing", "state.json"))
+	if _, err := b.Publish(subdomain{"home", 60, &ipv4, nil}); err == nil {
+		t.Errorf("expected error for an unwritable state file")
+	}
+	if got, _ := b.Load("home"); got.IPv4 != nil {
+		t.Errorf("record was kept although it was not persisted: %+v", got)
+	}
+}
+
+func TestDNSServerConfigValidate(t *testing.T) {
+	if err := (dnsServerConfig{Zone: "dyndns.example.com", NS: []string{"ns1.example.com"}}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := dnsServerConfig{}.validate()
+	if err == nil || !strings.Contains(err.Error(), "undefined zone") || !strings.Contains(err.Error(), "undefined name servers") {
+		t.Errorf("expected zone and name server errors, got %v", err)
+	}
+}
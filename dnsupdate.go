@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type rfc2136Config struct {
+	// Server is the host:port of the authoritative server accepting updates.
+	Server string
+	// Zone is the zone the host names are relative to, e.g. dyndns.example.com.
+	Zone string
+	// TSIGName and TSIGSecret are the key name and base64 secret as found in
+	// BIND or Knot key files.
+	TSIGName      string
+	TSIGSecret    string
+	TSIGAlgorithm string
+	Timeout       time.Duration
+}
+
+// dnsUpdateBackend publishes records by sending RFC 2136 UPDATE messages
+// signed with TSIG to an authoritative server.
+type dnsUpdateBackend struct {
+	server    string
+	zone      string
+	tsigName  string
+	tsigAlg   string
+	client    *dns.Client
+	published map[string]subdomain
+}
+
+func newDNSUpdateBackend(c rfc2136Config) *dnsUpdateBackend {
+	alg := c.TSIGAlgorithm
+	if alg == "" {
+		alg = dns.HmacSHA256
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	tsigName := dns.Fqdn(c.TSIGName)
+
+	return &dnsUpdateBackend{
+		server:   c.Server,
+		zone:     dns.Fqdn(c.Zone),
+		tsigName: tsigName,
+		tsigAlg:  dns.Fqdn(alg),
+		client: &dns.Client{
+			Timeout:    timeout,
+			TsigSecret: map[string]string{tsigName: c.TSIGSecret},
+		},
+		published: map[string]subdomain{},
+	}
+}
+
+func (s subdomain) equal(o subdomain) bool {
+	return s.Subpart == o.Subpart && s.TTL == o.TTL && sameAddr(s.IPv4, o.IPv4) && sameAddr(s.IPv6, o.IPv6)
+}
+
+// updateMsg replaces the A and AAAA records of s with its addresses. The
+// old records are removed in the same message, so the server applies both
+// atomically.
+func (b *dnsUpdateBackend) updateMsg(s subdomain) *dns.Msg {
+	name := dns.Fqdn(s.Subpart + "." + b.zone)
+
+	m := new(dns.Msg)
+	m.SetUpdate(b.zone)
+	m.RemoveRRset([]dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET}},
+	})
+
+	rrs := []dns.RR{}
+	if s.IPv4 != nil {
+		rrs = append(rrs, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(s.TTL)},
+			A:   net.IP(s.IPv4.AsSlice()),
+		})
+	}
+	if s.IPv6 != nil {
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(s.TTL)},
+			AAAA: net.IP(s.IPv6.AsSlice()),
+		})
+	}
+	if len(rrs) > 0 {
+		m.Insert(rrs)
+	}
+
+	m.SetTsig(b.tsigName, b.tsigAlg, 300, time.Now().Unix())
+	return m
+}
+
+// Publish sends an update unless s matches what was last published
+// successfully. After a restart the first update is always sent.
+func (b *dnsUpdateBackend) Publish(s subdomain) (bool, error) {
+	if prev, ok := b.published[s.Subpart]; ok && prev.equal(s) {
+		return false, nil
+	}
+
+	resp, _, err := b.client.Exchange(b.updateMsg(s), b.server)
+	if err != nil {
+		dnsUpdateErrorsTotal.Inc("")
+		return false, fmt.Errorf("cannot send dns update to %s: %w", b.server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		dnsUpdateErrorsTotal.Inc("")
+		return false, fmt.Errorf("dns update for %s.%s refused by %s: %s", s.Subpart, b.zone, b.server, dns.RcodeToString[resp.Rcode])
+	}
+
+	b.published[s.Subpart] = s
+	return true, nil
+}
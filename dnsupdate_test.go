@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testTSIGSecret = "c2VjcmV0LXRzaWcta2V5LWZvci10ZXN0cw=="
+
+// dnsUpdateServer starts an in-process authoritative server that accepts
+// UPDATE messages signed with testTSIGSecret and sends them to the returned
+// channel.
+func dnsUpdateServer(t *testing.T) (string, <-chan *dns.Msg) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates := make(chan *dns.Msg, 10)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{"dyndns.": testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default accept func answers everything but queries and
+		// notifies with NOTIMP.
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Opcode != dns.OpcodeUpdate || r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeNotAuth
+				w.WriteMsg(m)
+				return
+			}
+			updates <- r
+			m.SetTsig(r.IsTsig().Hdr.Name, r.IsTsig().Algorithm, 300, time.Now().Unix())
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return pc.LocalAddr().String(), updates
+}
+
+func TestDNSUpdateBackend(t *testing.T) {
+	addr, updates := dnsUpdateServer(t)
+	b := newDNSUpdateBackend(rfc2136Config{
+		Server:     addr,
+		Zone:       "dyndns.example.com",
+		TSIGName:   "dyndns",
+		TSIGSecret: testTSIGSecret,
+	})
+
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+
+	for _, testCase := range []struct {
+		name            string
+		s               subdomain
+		expectedChanged bool
+		expectedInserts []string
+	}{
+		{
+			name:            "v4 and v6",
+			s:               subdomain{"home", 60, &ipv4, &ipv6},
+			expectedChanged: true,
+			expectedInserts: []string{
+				"home.dyndns.example.com.\t60\tIN\tA\t192.168.1.1",
+				"home.dyndns.example.com.\t60\tIN\tAAAA\t2001:db8::1",
+			},
+		},
+		{
+			name:            "unchanged",
+			s:               subdomain{"home", 60, &ipv4, &ipv6},
+			expectedChanged: false,
+		},
+		{
+			name:            "v4 only",
+			s:               subdomain{"home", 120, &ipv4, nil},
+			expectedChanged: true,
+			expectedInserts: []string{"home.dyndns.example.com.\t120\tIN\tA\t192.168.1.1"},
+		},
+		{
+			name:            "delete",
+			s:               subdomain{"home", 120, nil, nil},
+			expectedChanged: true,
+			expectedInserts: []string{},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			changed, err := b.Publish(testCase.s)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if changed != testCase.expectedChanged {
+				t.Errorf("changed is %v instead of %v", changed, testCase.expectedChanged)
+			}
+
+			if !testCase.expectedChanged {
+				select {
+				case m := <-updates:
+					t.Errorf("unchanged records must not be sent, got %v", m)
+				default:
+				}
+				return
+			}
+
+			m := <-updates
+			if len(m.Question) != 1 || m.Question[0].Name != "dyndns.example.com." || m.Question[0].Qtype != dns.TypeSOA {
+				t.Errorf("zone section is %v instead of dyndns.example.com. SOA", m.Question)
+			}
+
+			removed := map[uint16]bool{}
+			inserts := []string{}
+			for _, rr := range m.Ns {
+				if rr.Header().Class == dns.ClassANY && rr.Header().Name == "home.dyndns.example.com." {
+					removed[rr.Header().Rrtype] = true
+					continue
+				}
+				inserts = append(inserts, rr.String())
+			}
+			if !removed[dns.TypeA] || !removed[dns.TypeAAAA] {
+				t.Errorf("old A and AAAA records are not removed: %v", m.Ns)
+			}
+			if len(inserts) != len(testCase.expectedInserts) {
+				t.Fatalf("inserted %v instead of %v", inserts, testCase.expectedInserts)
+			}
+			for i := range inserts {
+				if inserts[i] != testCase.expectedInserts[i] {
+					t.Errorf("inserted %q instead of %q", inserts[i], testCase.expectedInserts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDNSUpdateBackend_WrongKey(t *testing.T) {
+	addr, _ := dnsUpdateServer(t)
+	b := newDNSUpdateBackend(rfc2136Config{
+		Server:     addr,
+		Zone:       "dyndns.example.com",
+		TSIGName:   "dyndns",
+		TSIGSecret: "d3Jvbmctc2VjcmV0",
+	})
+
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	failures := dnsUpdateErrorsTotal.Value("")
+	if _, err := b.Publish(subdomain{"home", 60, &ipv4, nil}); err == nil {
+		t.Fatalf("expected error for update signed with the wrong key")
+	}
+	if got := dnsUpdateErrorsTotal.Value(""); got != failures+1 {
+		t.Errorf("dns update errors counter is %v instead of %v", got, failures+1)
+	}
+
+	// A failed update is not remembered, so the next one is sent again.
+	if len(b.published) != 0 {
+		t.Errorf("failed update was remembered as published: %v", b.published)
+	}
+}
+
+func TestZoneStore_DNSUpdateBackend(t *testing.T) {
+	addr, updates := dnsUpdateServer(t)
+	backend, err := newZoneBackend(updaterHandlerConfig{
+		Backends: []string{"rfc2136"},
+		RFC2136:  rfc2136Config{Server: addr, Zone: "dyndns.example.com.", TSIGName: "dyndns.", TSIGSecret: testTSIGSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newZoneStore(backend, "home")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := <-updates; len(m.Ns) != 3 {
+		t.Errorf("expected two removals and one insert, got %v", m.Ns)
+	}
+}
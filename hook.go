@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type postWriteConfig struct {
+	Command []string
+	Timeout time.Duration
+}
+
+// postWriteHook runs a command after the zonefile content changed, e.g. to
+// reload a service. Its Notify method is a writeListener and returns
+// immediately; runs are queued and executed one at a time by a single
+// worker, so they see updates in order.
+type postWriteHook struct {
+	command  []string
+	timeout  time.Duration
+	filename string
+	mu       sync.Mutex
+	queue    []hostState
+	running  bool
+	wg       sync.WaitGroup
+}
+
+func newPostWriteHook(c postWriteConfig, filename string) *postWriteHook {
+	return &postWriteHook{command: c.Command, timeout: c.Timeout, filename: filename}
+}
+
+func (p *postWriteHook) Notify(h hostState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.wg.Add(1)
+	p.queue = append(p.queue, h)
+	if !p.running {
+		p.running = true
+		go p.work()
+	}
+}
+
+// work runs the queued states in order and exits once the queue is empty.
+func (p *postWriteHook) work() {
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		h := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		p.run(h)
+		p.wg.Done()
+	}
+}
+
+func (p *postWriteHook) run(h hostState) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	exitStatus, err := runCommandStatus(ctx, p.command, []string{
+		"DYNDNS_HOST=" + h.Name,
+		"DYNDNS_IPV4=" + addrString(h.IPv4),
+		"DYNDNS_IPV6=" + addrString(h.IPv6),
+		fmt.Sprintf("DYNDNS_TTL=%d", h.TTL),
+		"DYNDNS_ZONEFILE=" + p.filename,
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		slog.Error("post-write command timed out", "command", p.command[0], "timeout", p.timeout, "exitStatus", exitStatus, "err", err)
+		return
+	}
+	if err != nil {
+		slog.Error("post-write command failed", "command", p.command[0], "exitStatus", exitStatus, "err", err)
+		return
+	}
+	slog.Info("post-write command finished", "command", p.command[0], "exitStatus", exitStatus)
+}
+
+// Wait blocks until all pending runs finished.
+func (p *postWriteHook) Wait() {
+	p.wg.Wait()
+}
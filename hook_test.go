@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostWriteHook(t *testing.T) {
+	dir := t.TempDir()
+	zonePath := filepath.Join(dir, "zone.txt")
+	out := filepath.Join(dir, "out")
+
+	hook := newPostWriteHook(postWriteConfig{
+		Command: []string{"sh", "-c", `echo "$DYNDNS_HOST $DYNDNS_IPV4 $DYNDNS_IPV6 $DYNDNS_TTL $DYNDNS_ZONEFILE" >> "$0"`, out},
+		Timeout: 10 * time.Second,
+	}, zonePath)
+
+	s := newZoneStore(newFileBackend(zonePath, newZonefile()), "home")
+	s.OnWrite(hook.Notify)
+
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	for _, h := range []hostState{
+		{Name: "home", TTL: 60, IPv4: &ipv4},
+		// Same content again: the hook must not run.
+		{Name: "home", TTL: 60, IPv4: &ipv4},
+		{Name: "home", TTL: 60, IPv4: &ipv4, IPv6: &ipv6},
+	} {
+		if _, err := s.Apply(h); err != nil {
+			t.Fatal(err)
+		}
+		hook.Wait()
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "home 192.168.1.1  60 " + zonePath + "\n" +
+		"home 192.168.1.1 2001:db8::1 60 " + zonePath + "\n"
+	if string(got) != expected {
+		t.Errorf("hook runs are %q instead of %q", got, expected)
+	}
+}
+
+func TestPostWriteHook_Order(t *testing.T) {
+	dir := t.TempDir()
+	zonePath := filepath.Join(dir, "zone.txt")
+	out := filepath.Join(dir, "out")
+
+	hook := newPostWriteHook(postWriteConfig{
+		Command: []string{"sh", "-c", `echo "$DYNDNS_IPV4" >> "$0"`, out},
+		Timeout: 10 * time.Second,
+	}, zonePath)
+
+	s := newZoneStore(newFileBackend(zonePath, newZonefile()), "home")
+	s.OnWrite(hook.Notify)
+
+	// Back-to-back updates queue up while the first run is still going.
+	expected := ""
+	for i := 1; i <= 20; i++ {
+		ipv4 := netip.AddrFrom4([4]byte{192, 168, 1, byte(i)})
+		if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+			t.Fatal(err)
+		}
+		expected += ipv4.String() + "\n"
+	}
+	hook.Wait()
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != expected {
+		t.Errorf("hook runs are %q instead of %q", got, expected)
+	}
+}
+
+func TestPostWriteHook_Timeout(t *testing.T) {
+	hook := newPostWriteHook(postWriteConfig{
+		Command: []string{"sleep", "10"},
+		Timeout: 50 * time.Millisecond,
+	}, "zone.txt")
+
+	start := time.Now()
+	hook.Notify(hostState{Name: "home"})
+	hook.Wait()
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hook was not killed after its timeout, took %v", elapsed)
+	}
+}
+
+func TestPostWriteHook_ExitStatus(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	for _, testCase := range []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"true"}, "exitStatus=0"},
+		{[]string{"sh", "-c", "exit 3"}, "exitStatus=3"},
+	} {
+		logs.Reset()
+		hook := newPostWriteHook(postWriteConfig{Command: testCase.command, Timeout: 10 * time.Second}, "zone.txt")
+		hook.Notify(hostState{Name: "home"})
+		hook.Wait()
+
+		if !strings.Contains(logs.String(), testCase.expected) {
+			t.Errorf("log of %v is missing %q: %s", testCase.command, testCase.expected, logs.String())
+		}
+	}
+}
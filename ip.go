@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ipEndpointConfig struct {
+	// RateLimit is the number of requests per Window a client may send to
+	// /ip. Zero disables the limit.
+	RateLimit int
+	Window    time.Duration
+}
+
+// rateLimiter counts requests per client in fixed windows. IPv6 clients are
+// counted per /64, as they usually own the whole prefix.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[netip.Prefix]int
+	now    func() time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: map[netip.Prefix]int{}, now: time.Now}
+}
+
+// SetLimit changes the limit, e.g. after a reload. Requests already counted
+// in the current window are kept.
+func (l *rateLimiter) SetLimit(limit int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit, l.window = limit, window
+}
+
+// Allow counts a request of addr and reports whether it is within the limit.
+// Otherwise it returns the time until the next window starts.
+func (l *rateLimiter) Allow(addr netip.Addr) (bool, time.Duration) {
+	bits := 32
+	if addr.Is6() {
+		bits = 64
+	}
+	key, _ := addr.Prefix(bits)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit <= 0 {
+		return true, 0
+	}
+
+	now := l.now()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		clear(l.counts)
+	}
+	if l.counts[key] >= l.limit {
+		return false, l.start.Add(l.window).Sub(now)
+	}
+	l.counts[key]++
+	return true, 0
+}
+
+func RateLimitMiddleware(l *rateLimiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, err := netip.ParseAddr(remoteHost(r))
+			if err != nil {
+				http.Error(w, "cannot determine client address", http.StatusBadRequest)
+				return
+			}
+			if ok, retryAfter := l.Allow(addr); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IPHandler answers with the address of the client, as plain text or, with
+// format=json or a matching Accept header, as JSON.
+func IPHandler(w http.ResponseWriter, r *http.Request) {
+	addr := remoteHost(r)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "json" || prefersJSON(r) {
+		writeJSON(w, http.StatusOK, struct {
+			IP string `json:"ip"`
+		}{addr})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, addr)
+}
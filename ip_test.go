@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPHandler(t *testing.T) {
+	for _, testCase := range []struct {
+		name                string
+		path                string
+		accept              string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"plain text", "/ip", "", "text/plain; charset=utf-8", "203.0.113.7\n"},
+		{"any", "/ip", "*/*", "text/plain; charset=utf-8", "203.0.113.7\n"},
+		{"json via accept", "/ip", "application/json", "application/json", `{"ip":"203.0.113.7"}`},
+		{"json via format", "/ip?format=json", "", "application/json", `{"ip":"203.0.113.7"}`},
+	} {
+		r := httptest.NewRequest(http.MethodGet, testCase.path, nil)
+		r.RemoteAddr = "203.0.113.7:1234"
+		if testCase.accept != "" {
+			r.Header.Set("Accept", testCase.accept)
+		}
+		w := httptest.NewRecorder()
+		IPHandler(w, r)
+
+		if got := w.Result().Header.Get("Content-Type"); got != testCase.expectedContentType {
+			t.Errorf("%s: content type is %q instead of %q", testCase.name, got, testCase.expectedContentType)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != strings.TrimSpace(testCase.expectedBody) {
+			t.Errorf("%s: body is %q instead of %q", testCase.name, got, testCase.expectedBody)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Minute)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	client := netip.MustParseAddr("203.0.113.7")
+	for i, expected := range []bool{true, true, false} {
+		if ok, _ := l.Allow(client); ok != expected {
+			t.Errorf("request %d allowed is %v instead of %v", i, ok, expected)
+		}
+	}
+	if ok, _ := l.Allow(netip.MustParseAddr("203.0.113.8")); !ok {
+		t.Errorf("other clients must not be limited")
+	}
+
+	// IPv6 clients are limited per /64.
+	l.Allow(netip.MustParseAddr("2001:db8::1"))
+	l.Allow(netip.MustParseAddr("2001:db8::2"))
+	if ok, _ := l.Allow(netip.MustParseAddr("2001:db8::3")); ok {
+		t.Errorf("addresses of the same /64 must share the limit")
+	}
+
+	now = now.Add(30 * time.Second)
+	if ok, retryAfter := l.Allow(client); ok || retryAfter != 30*time.Second {
+		t.Errorf("expected retry after 30s, got %v, %v", ok, retryAfter)
+	}
+	now = now.Add(30 * time.Second)
+	if ok, _ := l.Allow(client); !ok {
+		t.Errorf("limit was not reset after the window")
+	}
+
+	if ok, _ := newRateLimiter(0, time.Minute).Allow(client); !ok {
+		t.Errorf("a limit of zero must allow everything")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	handler := RateLimitMiddleware(newRateLimiter(1, time.Minute))(http.HandlerFunc(IPHandler))
+
+	for _, expectedStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/ip", nil)
+		r.RemoteAddr = "203.0.113.7:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Result().StatusCode != expectedStatus {
+			t.Errorf("status code is %v instead of %v", w.Result().StatusCode, expectedStatus)
+		}
+		if expectedStatus == http.StatusTooManyRequests && w.Result().Header.Get("Retry-After") == "" {
+			t.Errorf("missing Retry-After header")
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sebatec-eu/config-mate/hostsharing"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var listenFlags listenConfig
+
+func init() {
+	for _, cmd := range []*cobra.Command{rootCmd, serveDNSCmd} {
+		cmd.Flags().StringVar(&listenFlags.Addr, "listen", "", "run a standalone server on this address instead of FastCGI")
+		cmd.Flags().StringVar(&listenFlags.CertFile, "cert-file", "", "serve HTTPS with this certificate")
+		cmd.Flags().StringVar(&listenFlags.KeyFile, "key-file", "", "key of the certificate")
+	}
+}
+
+// applyListenFlags overrides c with the flags given on the command line.
+func applyListenFlags(cmd *cobra.Command, c *listenConfig) error {
+	if cmd.Flags().Changed("listen") {
+		c.Addr = listenFlags.Addr
+	}
+	if cmd.Flags().Changed("cert-file") {
+		c.CertFile = listenFlags.CertFile
+	}
+	if cmd.Flags().Changed("key-file") {
+		c.KeyFile = listenFlags.KeyFile
+	}
+	return c.validate()
+}
+
+type listenConfig struct {
+	// Addr runs a standalone server, e.g. ":8080", instead of
+	// hostsharing.ListenAndServe, which expects to run as FastCGI.
+	Addr string
+	// CertFile and KeyFile serve HTTPS. They are reloaded when they change.
+	CertFile string
+	KeyFile  string
+	// AutocertHosts serve HTTPS with certificates from Let's Encrypt, which
+	// are stored in AutocertCache.
+	AutocertHosts []string
+	AutocertCache string
+	// ShutdownTimeout is how long running requests, webhooks and post-write
+	// commands may take after SIGTERM.
+	ShutdownTimeout time.Duration
+}
+
+func (c listenConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("undefined certificate or key for listener")
+	}
+	if c.CertFile != "" && len(c.AutocertHosts) > 0 {
+		return fmt.Errorf("certificate files and autocert cannot be combined")
+	}
+	if len(c.AutocertHosts) > 0 && c.AutocertCache == "" {
+		return fmt.Errorf("undefined autocert cache")
+	}
+	if c.Addr == "" && (c.CertFile != "" || len(c.AutocertHosts) > 0) {
+		return fmt.Errorf("tls requires a listen address")
+	}
+	return nil
+}
+
+func (c listenConfig) tlsConfig() (*tls.Config, error) {
+	switch {
+	case c.CertFile != "":
+		certs := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+	case len(c.AutocertHosts) > 0:
+		// The TLS-ALPN-01 challenge is answered on the listener itself, so
+		// it has to be reachable on port 443.
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.AutocertHosts...),
+			Cache:      autocert.DirCache(c.AutocertCache),
+		}
+		return m.TLSConfig(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// certReloader loads a certificate again once its files changed, so renewed
+// certificates are picked up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime := time.Time{}
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			if r.cert != nil {
+				slog.Error("cannot reload certificate", "err", err)
+				return r.cert, nil
+			}
+			return nil, fmt.Errorf("cannot load certificate: %w", err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// Cert and key are usually not replaced at the same instant.
+			slog.Error("cannot reload certificate", "err", err)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("cannot load certificate: %w", err)
+	}
+	if r.cert != nil {
+		slog.Info("reloaded certificate", "file", r.certFile)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
+
+// runServer serves on ln until ctx is done and then shuts server down,
+// waiting up to timeout for running requests. With a TLSConfig it serves
+// HTTPS.
+func runServer(ctx context.Context, server *http.Server, ln net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ServeTLS(ln, "", "")
+			return
+		}
+		errs <- server.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server", "addr", ln.Addr().String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// listenAndServe runs handler on the standalone listener if c.Addr is set
+// and via hostsharing.ListenAndServe otherwise, until ctx is done.
+func listenAndServe(ctx context.Context, c listenConfig, handler http.Handler) error {
+	if c.Addr == "" {
+		// FastCGI cannot be shut down, so it is left running until the
+		// process exits. Running requests are waited for by the caller.
+		errs := make(chan error, 1)
+		go func() {
+			errs <- hostsharing.ListenAndServe(handler)
+		}()
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("server listening", "addr", ln.Addr().String(), "tls", tlsConfig != nil)
+	return runServer(ctx, &http.Server{Handler: handler, TLSConfig: tlsConfig}, ln, c.ShutdownTimeout)
+}
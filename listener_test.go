@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenConfig_Validate(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		c           listenConfig
+		expectedErr string
+	}{
+		{"fastcgi", listenConfig{}, ""},
+		{"plain http", listenConfig{Addr: ":8080"}, ""},
+		{"static certificate", listenConfig{Addr: ":443", CertFile: "cert.pem", KeyFile: "key.pem"}, ""},
+		{"autocert", listenConfig{Addr: ":443", AutocertHosts: []string{"dyndns.example.com"}, AutocertCache: "certs"}, ""},
+		{"missing key", listenConfig{Addr: ":443", CertFile: "cert.pem"}, "undefined certificate or key for listener"},
+		{"both", listenConfig{Addr: ":443", CertFile: "cert.pem", KeyFile: "key.pem", AutocertHosts: []string{"dyndns.example.com"}, AutocertCache: "certs"}, "cannot be combined"},
+		{"autocert without cache", listenConfig{Addr: ":443", AutocertHosts: []string{"dyndns.example.com"}}, "undefined autocert cache"},
+		{"tls without address", listenConfig{CertFile: "cert.pem", KeyFile: "key.pem"}, "tls requires a listen address"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.c.validate()
+			if testCase.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+				t.Errorf("error is %v instead of %q", err, testCase.expectedErr)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert := func(name string, modTime time.Time) {
+		t.Helper()
+		cert, key := ca.issue(t, &x509.Certificate{DNSNames: []string{name}})
+		for filename, content := range map[string][]byte{certFile: cert, keyFile: key} {
+			if err := os.WriteFile(filename, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filename, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dnsName := func(r *certReloader) string {
+		t.Helper()
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.DNSNames[0]
+	}
+
+	now := time.Now()
+	writeCert("old.example.com", now.Add(-time.Hour))
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if got := dnsName(r); got != "old.example.com" {
+		t.Fatalf("certificate is for %s", got)
+	}
+
+	writeCert("new.example.com", now)
+	if got := dnsName(r); got != "new.example.com" {
+		t.Errorf("certificate was not reloaded: %s", got)
+	}
+
+	// A broken renewal keeps the last good certificate.
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, now.Add(time.Hour), now.Add(time.Hour))
+	if got := dnsName(r); got != "new.example.com" {
+		t.Errorf("certificate is for %s after a broken renewal", got)
+	}
+}
+
+func TestRunServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("Ok"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(ctx, &http.Server{Handler: handler}, ln, time.Second)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := <-body; got != "Ok" {
+		t.Errorf("running request was not finished: %s", got)
+	}
+}
+
+func TestListenAndServe_FastCGIStopsWithContext(t *testing.T) {
+	t.Setenv("FCGI_LISTEN", "127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- listenAndServe(ctx, listenConfig{}, http.NotFoundHandler())
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("FastCGI server did not return after the context was done")
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"reflect"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -19,6 +25,21 @@ type serverConfig struct {
 	Logger         struct {
 		Enabled bool
 	}
+	Metrics   metricsConfig
+	Watchdog  watchdogConfig
+	Webhooks  []webhookConfig
+	PostWrite postWriteConfig
+	DNS       dnsServerConfig
+	// TrustedProxies are addresses or prefixes of reverse proxies whose
+	// X-Forwarded-For header is used to determine the client address.
+	TrustedProxies []string
+	IPEndpoint     ipEndpointConfig
+	// BotRules replace DEFAULT_BOT_RULES of the updater route.
+	BotRules []botRule
+	MTLS     mtlsConfig
+	// Listen runs a standalone server, e.g. in a container, instead of
+	// FastCGI.
+	Listen listenConfig
 }
 
 // base64StringToBytesHookFunc mirrors the unexported helper in
@@ -56,6 +77,27 @@ func loadServerConfig() (*serverConfig, error) {
 				KeyLen:  32,
 				Threads: 4,
 			},
+			Signing: signingConfig{
+				MaxSkew: 5 * time.Minute,
+			},
+		},
+		Watchdog: watchdogConfig{
+			Interval: time.Minute,
+			Timeout:  10 * time.Second,
+		},
+		PostWrite: postWriteConfig{
+			Timeout: 30 * time.Second,
+		},
+		DNS: dnsServerConfig{
+			Listen: ":53",
+			TTL:    3600,
+		},
+		IPEndpoint: ipEndpointConfig{
+			RateLimit: 60,
+			Window:    time.Minute,
+		},
+		Listen: listenConfig{
+			ShutdownTimeout: 10 * time.Second,
 		},
 	}
 
@@ -72,8 +114,38 @@ func loadServerConfig() (*serverConfig, error) {
 		validationErrors = append(validationErrors, fmt.Errorf("undefined user"))
 	}
 
-	if c.UpdaterHandler.Filename == "" {
-		validationErrors = append(validationErrors, fmt.Errorf("undefined filename for zonefile"))
+	backends := c.UpdaterHandler.Backends
+	if len(backends) == 0 {
+		backends = []string{"file"}
+	}
+	seenBackends := map[string]bool{}
+	for _, backend := range backends {
+		if seenBackends[backend] {
+			validationErrors = append(validationErrors, fmt.Errorf("duplicate backend %q", backend))
+			continue
+		}
+		seenBackends[backend] = true
+
+		switch backend {
+		case "file":
+			if c.UpdaterHandler.Filename == "" {
+				validationErrors = append(validationErrors, fmt.Errorf("undefined filename for zonefile"))
+			}
+		case "rfc2136":
+			rfc2136 := c.UpdaterHandler.RFC2136
+			if rfc2136.Server == "" || rfc2136.Zone == "" {
+				validationErrors = append(validationErrors, fmt.Errorf("undefined server or zone for rfc2136 backend"))
+			}
+			if rfc2136.TSIGName == "" || rfc2136.TSIGSecret == "" {
+				validationErrors = append(validationErrors, fmt.Errorf("undefined tsig key for rfc2136 backend"))
+			}
+		case "memory":
+			if c.UpdaterHandler.StateFile == "" {
+				validationErrors = append(validationErrors, fmt.Errorf("undefined state file for memory backend"))
+			}
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("unknown backend %q", backend))
+		}
 	}
 
 	if c.UpdaterHandler.DomainSubpart == "" {
@@ -88,6 +160,50 @@ func loadServerConfig() (*serverConfig, error) {
 		validationErrors = append(validationErrors, fmt.Errorf("undefined/short password salt"))
 	}
 
+	if len(c.UpdaterHandler.Signing.Secret) > 0 && len(c.UpdaterHandler.Signing.Secret) < 16 {
+		validationErrors = append(validationErrors, fmt.Errorf("short signing secret"))
+	}
+
+	if c.Metrics.Enabled && len(c.Metrics.Token) < 16 {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined/short metrics token"))
+	}
+
+	if c.UpdaterHandler.MaxAge > 0 && len(newNotifier(c.Watchdog.Notify)) == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("maxAge requires a watchdog notifier"))
+	}
+
+	if c.Watchdog.Notify.Mail.Addr != "" && (c.Watchdog.Notify.Mail.From == "" || len(c.Watchdog.Notify.Mail.To) == 0) {
+		validationErrors = append(validationErrors, fmt.Errorf("undefined sender or recipient for watchdog mail"))
+	}
+
+	if len(c.PostWrite.Command) > 0 && c.PostWrite.Timeout <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("post-write timeout must be positive"))
+	}
+
+	if _, err := newWebhookDispatcher(c.Webhooks); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		validationErrors = append(validationErrors, fmt.Errorf("trusted proxies: %w", err))
+	}
+
+	if _, err := parsePrefixes(c.UpdaterHandler.AllowedClients); err != nil {
+		validationErrors = append(validationErrors, fmt.Errorf("allowed clients: %w", err))
+	}
+
+	if _, err := newBotFilter(c.BotRules); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+
+	if err := c.MTLS.validate(); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+
+	if err := c.Listen.validate(); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+
 	if len(validationErrors) > 0 {
 		return nil, fmt.Errorf("missing required configuration: \n\n%s", errors.Join(validationErrors...))
 	}
@@ -95,32 +211,159 @@ func loadServerConfig() (*serverConfig, error) {
 	return &c, nil
 }
 
+// accessRules are the client checks of a configuration. They are built once
+// and shared by all handlers, so the password validator and the parsed
+// prefixes are not set up for each of them.
+type accessRules struct {
+	trusted  []netip.Prefix
+	allowed  []netip.Prefix
+	bots     *botFilter
+	validate passwordValidator
+}
+
+func newAccessRules(c *serverConfig) accessRules {
+	p := c.UpdaterHandler.Password
+	// The prefixes and bot rules are validated by loadServerConfig.
+	trusted, _ := parsePrefixes(c.TrustedProxies)
+	allowed, _ := parsePrefixes(c.UpdaterHandler.AllowedClients)
+	bots, _ := newBotFilter(c.BotRules)
+	return accessRules{
+		trusted:  trusted,
+		allowed:  allowed,
+		bots:     bots,
+		validate: argonPasswordValidator(p.Key, p.Salt, p.Time, p.Memory, p.Threads, p.KeyLen),
+	}
+}
+
+func newRouter(c *serverConfig, s *zoneStore, state *serverState, access accessRules) http.Handler {
+	r := chi.NewRouter()
+	if c.Logger.Enabled {
+		r.Use(hostsharing.RequestLogger())
+	}
+	r.Use(middleware.Heartbeat("/ping"))
+	r.Use(ClientAddrMiddleware(access.trusted))
+
+	// The bot filter wraps only the updater route, so /ping, /ip, the API
+	// and the status page stay accessible.
+	r.Route("/", func(sub chi.Router) {
+		sub.Use(access.bots.Middleware)
+		sub.Mount("/", updaterHandler(c.UpdaterHandler, s, state.nonces, access))
+	})
+	r.With(RateLimitMiddleware(state.ipLimiter)).Get("/ip", IPHandler)
+	r.Mount("/api/v1", apiHandler(c.UpdaterHandler, s, access))
+	r.Mount("/status", statusHandler(c.UpdaterHandler, s, access))
+	if c.Metrics.Enabled {
+		r.With(BearerTokenMiddleware(c.Metrics.Token)).Get("/metrics", MetricsHandler(s))
+	}
+	return r
+}
+
+// serverSetup is what setupServer built from one configuration.
+type serverSetup struct {
+	store *zoneStore
+	// handler serves the usual endpoints and mtls the mtls listener. Both
+	// count their requests in requests, which must wrap them when serving.
+	handler  http.Handler
+	mtls     http.Handler
+	requests *inflight
+	// shutdown waits for running requests of both handlers and the
+	// webhooks and post-write commands they started.
+	shutdown func(context.Context) error
+}
+
+// setupServer wires the store, its listeners and the watchdog as configured
+// and returns the store together with the HTTP handlers serving it. state
+// is shared with the previous configuration, if any.
+func setupServer(ctx context.Context, config *serverConfig, state *serverState) (*serverSetup, error) {
+	backend, err := state.zoneBackend(config.UpdaterHandler)
+	if err != nil {
+		return nil, err
+	}
+	store := newZoneStore(backend, config.UpdaterHandler.DomainSubpart)
+	store.mu = &state.mu
+	state.nonces.SetTTL(2 * config.UpdaterHandler.Signing.MaxSkew)
+	state.ipLimiter.SetLimit(config.IPEndpoint.RateLimit, config.IPEndpoint.Window)
+	if err := store.Sync(); err != nil {
+		return nil, err
+	}
+	webhooks, err := newWebhookDispatcher(config.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	store.OnChange(webhooks.Notify)
+	waits := []func(){webhooks.Wait}
+
+	if len(config.PostWrite.Command) > 0 {
+		hook := newPostWriteHook(config.PostWrite, config.UpdaterHandler.Filename)
+		store.OnWrite(hook.Notify)
+		waits = append(waits, hook.Wait)
+	}
+
+	if config.UpdaterHandler.MaxAge > 0 {
+		wd := newWatchdog(store,
+			map[string]time.Duration{config.UpdaterHandler.DomainSubpart: config.UpdaterHandler.MaxAge},
+			newNotifier(config.Watchdog.Notify),
+			config.Watchdog.Timeout,
+			state.watchdog,
+		)
+		go wd.Run(ctx, config.Watchdog.Interval)
+	}
+
+	access := newAccessRules(config)
+	requests := &inflight{}
+	shutdown := func(ctx context.Context) error {
+		if err := requests.Drain(ctx); err != nil {
+			return err
+		}
+		for _, wait := range waits {
+			if err := waitContext(ctx, wait); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return &serverSetup{
+		store:    store,
+		handler:  newRouter(config, store, state, access),
+		mtls:     mtlsHandler(config, store, access),
+		requests: requests,
+		shutdown: shutdown,
+	}, nil
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "hostsharing-dyndns",
 	Short: "hostsharing-dyndns is a dyndns service for Hostsharing e.G.",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		config, err := loadServerConfig()
+		load := func() (*serverConfig, error) {
+			config, err := loadServerConfig()
+			if err != nil {
+				return nil, err
+			}
+			if err := applyListenFlags(cmd, &config.Listen); err != nil {
+				return nil, err
+			}
+			return config, nil
+		}
+		config, err := load()
 		if err != nil {
 			return err
 		}
 
-		r := chi.NewRouter()
-		if config.Logger.Enabled {
-			r.Use(hostsharing.RequestLogger())
+		r, err := newReloader(cmd.Context(), config, load)
+		if err != nil {
+			return err
 		}
-		r.Use(middleware.Heartbeat("/ping"))
+		go r.Watch(cmd.Context(), configFile())
 
-		// RejectBots wraps only the updater route, so /ping stays
-		// accessible to health checks.
-		r.Route("/", func(sub chi.Router) {
-			sub.Use(RejectBotsMiddleware)
-			sub.Mount("/", updaterHandler(config.UpdaterHandler))
-		})
-
-		if err := hostsharing.ListenAndServe(r); err != nil {
+		errs := make(chan error, 2)
+		if err := startMTLS(cmd.Context(), config, r.MTLSHandler(), errs); err != nil {
 			return err
 		}
-		return nil
+		go func() {
+			errs <- listenAndServe(cmd.Context(), config.Listen, r)
+		}()
+		return waitForShutdown(cmd.Context(), errs, r.Shutdown, config.Listen.ShutdownTimeout)
 	},
 }
 
@@ -135,8 +378,10 @@ var validateConfigCmd = &cobra.Command{
 }
 
 func main() {
-	rootCmd.AddCommand(validateConfigCmd, generatePasswordCmd)
-	if err := rootCmd.Execute(); err != nil {
+	rootCmd.AddCommand(validateConfigCmd, generatePasswordCmd, verifyPasswordCmd, serveDNSCmd, rollbackCmd, clientCmd)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBase64StringToBytesHookFunc(t *testing.T) {
@@ -98,6 +104,9 @@ UpdaterHandler:
     KeyLen: 32
 Logger:
   Enabled: true
+Metrics:
+  Enabled: true
+  Token: 0123456789abcdef
 `
 
 	for _, testCase := range []struct {
@@ -111,6 +120,33 @@ Logger:
 		{"missing domain subpart", strings.Replace(valid, "DomainSubpart: HOME.dyndns.example.com", `DomainSubpart: ""`, 1), []string{"undefined domain subpart"}},
 		{"short key", strings.Replace(valid, "Key: AAECAwQFBgcICQoLDA0ODw==", "Key: AA==", 1), []string{"undefined/short password key"}},
 		{"short salt", strings.Replace(valid, "Salt: AAECAwQFBgcICQoLDA0ODw==", "Salt: AA==", 1), []string{"undefined/short password salt"}},
+		{"short metrics token", strings.Replace(valid, "Token: 0123456789abcdef", "Token: short", 1), []string{"undefined/short metrics token"}},
+		{"max age without notifier", strings.Replace(valid, "  DomainSubpart: HOME.dyndns.example.com", "  DomainSubpart: HOME.dyndns.example.com\n  MaxAge: 48h", 1), []string{"maxAge requires a watchdog notifier"}},
+		{"max age with notifier", strings.Replace(valid, "  DomainSubpart: HOME.dyndns.example.com", "  DomainSubpart: HOME.dyndns.example.com\n  MaxAge: 48h", 1) + "Watchdog:\n  Notify:\n    Command: [true]\n", nil},
+		{"mail without recipient", valid + "Watchdog:\n  Notify:\n    Mail:\n      Addr: localhost:25\n", []string{"undefined sender or recipient for watchdog mail"}},
+		{"rfc2136 backend without filename", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Backends: [rfc2136]\n  RFC2136:\n    Server: 127.0.0.1:53\n    Zone: dyndns.example.com\n    TSIGName: dyndns\n    TSIGSecret: c2VjcmV0", 1), nil},
+		{"rfc2136 backend without tsig", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Backends: [rfc2136]\n  RFC2136:\n    Server: 127.0.0.1:53\n    Zone: dyndns.example.com", 1), []string{"undefined tsig key for rfc2136 backend"}},
+		{"rfc2136 backend without server", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Backends: [rfc2136]", 1), []string{"undefined server or zone for rfc2136 backend", "undefined tsig key for rfc2136 backend"}},
+		{"file and rfc2136 backend", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Filename: /tmp/zone.txt\n  Backends: [file, rfc2136]", 1), []string{"undefined server or zone for rfc2136 backend", "undefined tsig key for rfc2136 backend"}},
+		{"duplicate backend", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Filename: /tmp/zone.txt\n  Backends: [file, file]", 1), []string{`duplicate backend "file"`}},
+		{"memory backend without filename", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Backends: [memory]\n  StateFile: /tmp/state.json", 1), nil},
+		{"memory backend without state file", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Backends: [memory]", 1), []string{"undefined state file for memory backend"}},
+		{"unknown backend", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Backends: [s3]", 1), []string{`unknown backend "s3"`}},
+		{"trusted proxies", valid + "TrustedProxies: [127.0.0.1, \"10.0.0.0/8\"]\n", nil},
+		{"invalid trusted proxy", valid + "TrustedProxies: [proxy.example.com]\n", []string{`trusted proxies: invalid address or prefix "proxy.example.com"`}},
+		{"bot rules", valid + "BotRules:\n  - Methods: [get, post]\n    Paths: [\"/\", \"/nic/*\"]\n    Params: [user]\n    DenyUserAgents: [\"(?i)curl\"]\n", nil},
+		{"invalid bot rule", valid + "BotRules:\n  - DenyUserAgents: [\"(\"]\n", []string{"bot rule 0: invalid user agent pattern"}},
+		{"allowed clients", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Filename: /tmp/zone.txt\n  AllowedClients: [\"192.0.2.0/24\", \"2001:db8::/32\"]\n  RequireSourceMatch: true", 1), nil},
+		{"invalid allowed client", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Filename: /tmp/zone.txt\n  AllowedClients: [router.example.com]", 1), []string{`allowed clients: invalid address or prefix "router.example.com"`}},
+		{"short signing secret", strings.Replace(valid, "  Filename: /tmp/zone.txt", "  Filename: /tmp/zone.txt\n  Signing:\n    Secret: AAECAwQFBgc=", 1), []string{"short signing secret"}},
+		{"mtls listener", valid + "MTLS:\n  Listen: \":8443\"\n  CertFile: cert.pem\n  KeyFile: key.pem\n  ClientCA: ca.pem\n  Names: [router.example.com]\n", nil},
+		{"mtls listener without ca", valid + "MTLS:\n  Listen: \":8443\"\n  CertFile: cert.pem\n  KeyFile: key.pem\n", []string{"undefined client ca for mtls listener"}},
+		{"standalone listener", valid + "Listen:\n  Addr: \":8443\"\n  CertFile: cert.pem\n  KeyFile: key.pem\n", nil},
+		{"listener without key", valid + "Listen:\n  Addr: \":8443\"\n  CertFile: cert.pem\n", []string{"undefined certificate or key for listener"}},
+		{"post-write command", valid + "PostWrite:\n  Command: [true]\n", nil},
+		{"post-write without timeout", valid + "PostWrite:\n  Command: [true]\n  Timeout: 0s\n", []string{"post-write timeout must be positive"}},
+		{"webhook without url", valid + "Webhooks:\n  - Method: POST\n", []string{"undefined webhook url"}},
+		{"metrics disabled without token", strings.Replace(valid, "  Enabled: true\n  Token: 0123456789abcdef", "  Enabled: false", 1), nil},
 		{
 			// All five validators must trip; errors.Join aggregates them.
 			"all five missing",
@@ -154,3 +190,83 @@ Logger:
 		})
 	}
 }
+
+// TestNewRouter verifies that the API and the status page are mounted next to
+// the updater and are not filtered by the bot filter.
+func TestNewRouter(t *testing.T) {
+	c := &serverConfig{UpdaterHandler: testUpdaterConfig(t)}
+	r := newRouter(c, newZoneStore(newFileBackend(c.UpdaterHandler.Filename, newZonefile()), c.UpdaterHandler.DomainSubpart), newServerState(), newAccessRules(c))
+
+	for _, testCase := range []struct {
+		name           string
+		path           string
+		basicAuth      bool
+		expectedStatus int
+	}{
+		{"heartbeat", "/ping", false, http.StatusOK},
+		{"ip without credentials", "/ip", false, http.StatusOK},
+		{"updater without user is rejected", "/", false, http.StatusForbidden},
+		{"updater with wrong password", "/?user=dyndns&passwd=d3JvbmctcGFzc3dvcmQ", false, http.StatusUnauthorized},
+		{"api without credentials", "/api/v1/hosts", false, http.StatusUnauthorized},
+		{"api", "/api/v1/hosts", true, http.StatusOK},
+		{"status without credentials", "/status", false, http.StatusUnauthorized},
+		{"status", "/status", true, http.StatusOK},
+		{"metrics disabled", "/metrics", false, http.StatusForbidden},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", testCase.path, nil)
+			if testCase.basicAuth {
+				req.SetBasicAuth("dyndns", "c2VjcmV0LXBhc3N3b3Jk")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Result().StatusCode != testCase.expectedStatus {
+				t.Errorf("status code is %v instead of %v", w.Result().StatusCode, testCase.expectedStatus)
+			}
+		})
+	}
+}
+
+// TestSetupServer_Shutdown verifies that shutdown waits for the post-write
+// command started by an update, so a deploy does not cut it off.
+func TestSetupServer_Shutdown(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "reloaded")
+	c := &serverConfig{
+		UpdaterHandler: updaterHandlerConfig{
+			Filename:      filepath.Join(dir, "zone.txt"),
+			DomainSubpart: "home",
+		},
+		PostWrite: postWriteConfig{
+			Command: []string{"sh", "-c", "sleep 0.05 && touch " + marker},
+			Timeout: time.Second,
+		},
+	}
+
+	setup, err := setupServer(context.Background(), c, newServerState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ipv4 := netip.MustParseAddr("192.0.2.1")
+	if _, err := setup.store.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := setup.shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("post-write command did not finish before shutdown returned: %v", err)
+	}
+
+	// Both listeners are drained, so no update can start after shutdown.
+	for name, handler := range map[string]http.Handler{"handler": setup.handler, "mtls": setup.mtls} {
+		w := httptest.NewRecorder()
+		setup.requests.Middleware(handler).ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s responds with %d after shutdown", name, w.Code)
+		}
+	}
+}
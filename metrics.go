@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricsConfig struct {
+	Enabled bool
+	Token   string
+}
+
+// counterVec is a Prometheus counter partitioned by a single label. An empty
+// label name makes it a plain counter.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: map[string]float64{}}
+}
+
+func (c *counterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+func (c *counterVec) Value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+
+	labelValues := make([]string, 0, len(c.values))
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+	sort.Strings(labelValues)
+	for _, v := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", c.name, c.label, escapeLabelValue(v), formatFloat(c.values[v]))
+	}
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+var (
+	updatesTotal             = newCounterVec("dyndns_updates_total", "Updater requests by result.", "result")
+	authFailuresTotal        = newCounterVec("dyndns_auth_failures_total", "Requests rejected because of wrong credentials.", "")
+	rejectedBotsTotal        = newCounterVec("dyndns_rejected_bots_total", "Requests rejected by the bot filter.", "")
+	zonefileWriteErrorsTotal = newCounterVec("dyndns_zonefile_write_errors_total", "Failed attempts to write the zonefile.", "")
+	dnsUpdateErrorsTotal     = newCounterVec("dyndns_dns_update_errors_total", "Failed RFC 2136 updates.", "")
+	argonVerificationSeconds = newHistogram("dyndns_argon2_verification_seconds", "Duration of argon2id password verifications.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5})
+)
+
+// Results counted by updatesTotal.
+const (
+	updateResultChanged   = "changed"
+	updateResultUnchanged = "unchanged"
+	updateResultEmpty     = "empty"
+	updateResultError     = "error"
+)
+
+func observeDuration(h *histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// writeHostMetrics exposes the time of the last successful update per host.
+// Hosts that were never updated since start are left out.
+func writeHostMetrics(w io.Writer, s *zoneStore) {
+	const name = "dyndns_host_last_update_timestamp_seconds"
+	fmt.Fprintf(w, "# HELP %s Unix time of the last successful update per host.\n# TYPE %s gauge\n", name, name)
+	for _, h := range s.Hosts() {
+		if h.UpdatedAt.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "%s{host=\"%s\"} %s\n", name, escapeLabelValue(h.Name), formatFloat(float64(h.UpdatedAt.UnixMilli())/1000))
+	}
+}
+
+func MetricsHandler(s *zoneStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		updatesTotal.writeTo(w)
+		authFailuresTotal.writeTo(w)
+		rejectedBotsTotal.writeTo(w)
+		zonefileWriteErrorsTotal.writeTo(w)
+		dnsUpdateErrorsTotal.writeTo(w)
+		argonVerificationSeconds.writeTo(w)
+		writeHostMetrics(w, s)
+	}
+}
+
+// BearerTokenMiddleware protects an endpoint with a static bearer token, so
+// the Prometheus scraper does not need the updater credentials.
+func BearerTokenMiddleware(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			unverifiedToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(unverifiedToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hostsharing-dyndns"`)
+				http.Error(w, "token wrong", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
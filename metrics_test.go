@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "result")
+	c.Inc("b")
+	c.Inc("a")
+	c.Inc("b")
+	c.Inc(`quo"te`)
+
+	var b strings.Builder
+	c.writeTo(&b)
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{result="a"} 1
+test_total{result="b"} 2
+test_total{result="quo\"te"} 1
+`
+	if b.String() != expected {
+		t.Errorf("exposition does not look as expected:\n%s\ninstead of\n%s", b.String(), expected)
+	}
+
+	plain := newCounterVec("plain_total", "Plain counter.", "")
+	b.Reset()
+	plain.writeTo(&b)
+	if !strings.HasSuffix(b.String(), "\nplain_total 0\n") {
+		t.Errorf("unlabeled counter without increments should be exported as 0: %q", b.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var b strings.Builder
+	h.writeTo(&b)
+
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if b.String() != expected {
+		t.Errorf("exposition does not look as expected:\n%s\ninstead of\n%s", b.String(), expected)
+	}
+}
+
+func TestBearerTokenMiddleware(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		token              string
+		authorization      string
+		expectedStatusCode int
+	}{
+		{"missing header", "0123456789abcdef", "", 401},
+		{"wrong scheme", "0123456789abcdef", "Basic 0123456789abcdef", 401},
+		{"wrong token", "0123456789abcdef", "Bearer fedcba9876543210", 401},
+		{"empty configured token", "", "Bearer ", 401},
+		{"valid", "0123456789abcdef", "Bearer 0123456789abcdef", 200},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := BearerTokenMiddleware(testCase.token)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if testCase.authorization != "" {
+				req.Header.Set("Authorization", testCase.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Result().StatusCode != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v", w.Result().StatusCode, testCase.expectedStatusCode)
+			}
+		})
+	}
+}
+
+// TestMetricsInstrumentation drives requests through the real router and
+// checks that each metric moves.
+func TestMetricsInstrumentation(t *testing.T) {
+	c := &serverConfig{UpdaterHandler: testUpdaterConfig(t)}
+	c.Metrics = metricsConfig{Enabled: true, Token: "0123456789abcdef"}
+	s := newZoneStore(newFileBackend(c.UpdaterHandler.Filename, newZonefile()), c.UpdaterHandler.DomainSubpart)
+	r := newRouter(c, s, newServerState(), newAccessRules(c))
+
+	do := func(path string) {
+		t.Helper()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rejected := rejectedBotsTotal.Value("")
+	do("/.env")
+	if got := rejectedBotsTotal.Value(""); got != rejected+1 {
+		t.Errorf("rejected bots counter is %v instead of %v", got, rejected+1)
+	}
+
+	authFailures := authFailuresTotal.Value("")
+	verifications := argonVerificationSeconds.Count()
+	do("/?user=dyndns&passwd=d3JvbmctcGFzc3dvcmQ")
+	if got := authFailuresTotal.Value(""); got != authFailures+1 {
+		t.Errorf("auth failures counter is %v instead of %v", got, authFailures+1)
+	}
+	if got := argonVerificationSeconds.Count(); got != verifications+1 {
+		t.Errorf("argon2 histogram count is %v instead of %v", got, verifications+1)
+	}
+
+	changed := updatesTotal.Value(updateResultChanged)
+	unchanged := updatesTotal.Value(updateResultUnchanged)
+	do("/?user=dyndns&passwd=c2VjcmV0LXBhc3N3b3Jk&ipaddr=192.168.1.1")
+	do("/?user=dyndns&passwd=c2VjcmV0LXBhc3N3b3Jk&ipaddr=192.168.1.1")
+	if got := updatesTotal.Value(updateResultChanged); got != changed+1 {
+		t.Errorf("changed updates counter is %v instead of %v", got, changed+1)
+	}
+	if got := updatesTotal.Value(updateResultUnchanged); got != unchanged+1 {
+		t.Errorf("unchanged updates counter is %v instead of %v", got, unchanged+1)
+	}
+
+	writeErrors := zonefileWriteErrorsTotal.Value("")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	broken := newZoneStore(newFileBackend(filepath.Join(t.TempDir(), "missing", "zone.txt"), newZonefile()), "home")
+	if _, err := broken.Apply(hostState{Name: "home", IPv4: &ipv4}); err == nil {
+		t.Fatalf("expected write error")
+	}
+	if got := zonefileWriteErrorsTotal.Value(""); got != writeErrors+1 {
+		t.Errorf("zonefile write errors counter is %v instead of %v", got, writeErrors+1)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	r.ServeHTTP(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("status code is %v instead of %v", w.Result().StatusCode, http.StatusOK)
+	}
+	for _, want := range []string{
+		`dyndns_updates_total{result="changed"} `,
+		"dyndns_auth_failures_total ",
+		"dyndns_rejected_bots_total ",
+		"dyndns_zonefile_write_errors_total ",
+		"dyndns_argon2_verification_seconds_count ",
+		`dyndns_host_last_update_timestamp_seconds{host="home"} `,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics are missing %q:\n%s", want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sebatec-eu/config-mate/hostsharing"
+)
+
+type mtlsConfig struct {
+	// Listen enables a separate HTTPS listener, e.g. ":8443", that only
+	// accepts clients with a certificate signed by ClientCA.
+	Listen   string
+	CertFile string
+	KeyFile  string
+	// ClientCA is a PEM file with the certificates client certificates
+	// must chain up to.
+	ClientCA string
+	// Names are subjects or SANs of client certificates that may update
+	// DomainSubpart without user and password.
+	Names []string
+}
+
+func (c mtlsConfig) validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("undefined certificate or key for mtls listener")
+	}
+	if c.ClientCA == "" {
+		return fmt.Errorf("undefined client ca for mtls listener")
+	}
+	if len(c.Names) == 0 {
+		return fmt.Errorf("undefined client certificate names for mtls listener")
+	}
+	return nil
+}
+
+func (c mtlsConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate: %w", err)
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client ca %s", c.ClientCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// certificateNames returns the subject common name and all SANs of cert.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// ClientCertMiddleware lets requests through whose verified client
+// certificate carries one of names. It replaces UserValidationMiddleware and
+// PasswordValidationMiddleware on the mtls listener.
+func ClientCertMiddleware(names []string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				authFailuresTotal.Inc("")
+				http.Error(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+
+			leaf := r.TLS.VerifiedChains[0][0]
+			if !slices.ContainsFunc(certificateNames(leaf), func(name string) bool {
+				return slices.Contains(names, name)
+			}) {
+				authFailuresTotal.Inc("")
+				http.Error(w, "client certificate not allowed", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func mtlsHandler(c *serverConfig, s *zoneStore, access accessRules) http.Handler {
+	r := chi.NewRouter()
+	if c.Logger.Enabled {
+		r.Use(hostsharing.RequestLogger())
+	}
+	r.Use(middleware.Heartbeat("/ping"))
+	r.Use(ClientAllowlistMiddleware(access.allowed))
+	r.With(ClientCertMiddleware(c.MTLS.Names)).Handle("/", addressHandler(c.UpdaterHandler, s))
+	return r
+}
+
+// startMTLS serves handler on c.MTLS.Listen, if configured, until ctx is
+// done and reports the result of the server to errs.
+func startMTLS(ctx context.Context, c *serverConfig, handler http.Handler, errs chan<- error) error {
+	if c.MTLS.Listen == "" {
+		return nil
+	}
+	tlsConfig, err := c.MTLS.tlsConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", c.MTLS.Listen)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+	go func() {
+		slog.Info("mtls server listening", "addr", ln.Addr().String())
+		errs <- runServer(ctx, server, ln, c.Listen.ShutdownTimeout)
+	}()
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the mtls tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key for template.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTempFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestMTLSHandler(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	c := &serverConfig{
+		UpdaterHandler: updaterHandlerConfig{DomainSubpart: "home"},
+		MTLS: mtlsConfig{
+			CertFile: writeTempFile(t, "cert.pem", serverCert),
+			KeyFile:  writeTempFile(t, "key.pem", serverKey),
+			ClientCA: writeTempFile(t, "ca.pem", ca.pem),
+			Names:    []string{"router.example.com"},
+		},
+	}
+	tlsConfig, err := c.MTLS.tlsConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	store := newZoneStore(testMemoryBackend(t, ""), "home")
+	server := httptest.NewUnstartedServer(mtlsHandler(c, store, newAccessRules(c)))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientFor := func(template *x509.Certificate) *http.Client {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+		if template != nil {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+			certPEM, keyPEM := ca.issue(t, template)
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: transport}
+	}
+
+	for _, testCase := range []struct {
+		name               string
+		template           *x509.Certificate
+		expectedStatusCode int
+	}{
+		{"allowed san", &x509.Certificate{DNSNames: []string{"router.example.com"}}, 200},
+		{"allowed subject", &x509.Certificate{Subject: pkix.Name{CommonName: "router.example.com"}}, 200},
+		{"other name", &x509.Certificate{DNSNames: []string{"laptop.example.com"}}, 403},
+		{"without certificate", nil, 0},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp, err := clientFor(testCase.template).Get(server.URL + "/?ipaddr=192.0.2.1")
+			if testCase.expectedStatusCode == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("request without client certificate succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v", resp.StatusCode, testCase.expectedStatusCode)
+			}
+		})
+	}
+
+	h, _ := store.Host("home")
+	if h.IPv4 == nil || *h.IPv4 != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("published address is %v", h.IPv4)
+	}
+}
+
+func TestMTLSConfig_TLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, &x509.Certificate{DNSNames: []string{"dyndns.example.com"}})
+	certFile := writeTempFile(t, "cert.pem", cert)
+	keyFile := writeTempFile(t, "key.pem", key)
+
+	for _, testCase := range []struct {
+		name        string
+		c           mtlsConfig
+		expectedErr string
+	}{
+		{"valid", mtlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCA: writeTempFile(t, "ca.pem", ca.pem)}, ""},
+		{"missing key", mtlsConfig{CertFile: certFile, KeyFile: certFile, ClientCA: writeTempFile(t, "ca.pem", ca.pem)}, "cannot load certificate"},
+		{"missing ca", mtlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCA: filepath.Join(t.TempDir(), "ca.pem")}, "cannot read client ca"},
+		{"empty ca", mtlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCA: writeTempFile(t, "ca.pem", []byte("nope"))}, "no certificates found"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			tlsConfig, err := testCase.c.tlsConfig()
+			if testCase.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+					t.Errorf("client auth is %v", tlsConfig.ClientAuth)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+				t.Errorf("error is %v instead of %q", err, testCase.expectedErr)
+			}
+		})
+	}
+}
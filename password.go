@@ -4,24 +4,52 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/argon2"
 	"gopkg.in/yaml.v3"
 )
 
-func argonPasswordValidator(key []byte, salt []byte, time, memory uint32, threads uint8, keyLen uint32) passwordValidator {
+func argonPasswordValidator(key []byte, salt []byte, timeCost, memory uint32, threads uint8, keyLen uint32) passwordValidator {
 	return func(origPasswd []byte) bool {
-		unverifiedKey := argon2.IDKey(origPasswd, salt, time, memory, threads, keyLen)
+		defer observeDuration(argonVerificationSeconds, time.Now())
+		unverifiedKey := argon2.IDKey(origPasswd, salt, timeCost, memory, threads, keyLen)
 		return subtle.ConstantTimeCompare(key, unverifiedKey) == 1
 	}
 }
 
+var (
+	errUserMismatch   = errors.New("user does not match configured user")
+	errPasswordDecode = errors.New("password is not valid base64url")
+	errHashMismatch   = errors.New("argon2id key derived from password does not match configured key")
+)
+
+// verifyCredentials runs the same checks as the updater middlewares, in the
+// same order, and reports the first step that fails.
+func verifyCredentials(c updaterHandlerConfig, user, passwd string) error {
+	if subtle.ConstantTimeCompare([]byte(c.User), []byte(user)) != 1 {
+		return errUserMismatch
+	}
+
+	decodedPasswd, err := base64.RawURLEncoding.DecodeString(passwd)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPasswordDecode, err)
+	}
+
+	p := c.Password
+	if !argonPasswordValidator(p.Key, p.Salt, p.Time, p.Memory, p.Threads, p.KeyLen)(decodedPasswd) {
+		return errHashMismatch
+	}
+	return nil
+}
+
 var (
 	saltLength   uint16
 	passwdLength uint16
-	time         uint32
+	argonTime    uint32
 	memory       uint32
 	threads      uint8
 	keyLen       uint32
@@ -30,7 +58,7 @@ var (
 func init() {
 	generatePasswordCmd.Flags().Uint16VarP(&saltLength, "salt", "s", 16, "byte size of generated salt")
 	generatePasswordCmd.Flags().Uint16VarP(&passwdLength, "password", "p", 32, "byte size of generated password")
-	generatePasswordCmd.Flags().Uint32Var(&time, "time", 1, "argon2id time parameter")
+	generatePasswordCmd.Flags().Uint32Var(&argonTime, "time", 1, "argon2id time parameter")
 	generatePasswordCmd.Flags().Uint32VarP(&memory, "memory", "m", 64*1024, "argon2id memory parameter")
 	generatePasswordCmd.Flags().Uint8Var(&threads, "threads", 4, "argon2id threads parameter")
 	generatePasswordCmd.Flags().Uint32Var(&keyLen, "key-length", 32, "argon2id key length parameter")
@@ -59,7 +87,7 @@ var generatePasswordCmd = &cobra.Command{
 			return err
 		}
 
-		key := argon2.IDKey(decPasswd, salt, time, memory, threads, keyLen)
+		key := argon2.IDKey(decPasswd, salt, argonTime, memory, threads, keyLen)
 
 		config, err := yaml.Marshal(struct {
 			Key     string
@@ -71,7 +99,7 @@ var generatePasswordCmd = &cobra.Command{
 		}{
 			Key:     base64.URLEncoding.EncodeToString(key),
 			Salt:    base64.URLEncoding.EncodeToString(salt),
-			Time:    time,
+			Time:    argonTime,
 			Memory:  memory,
 			Threads: threads,
 			KeyLen:  keyLen,
@@ -84,3 +112,23 @@ var generatePasswordCmd = &cobra.Command{
 		return nil
 	},
 }
+
+var verifyPasswordCmd = &cobra.Command{
+	Use:     "verifyPassword <user> <password>",
+	Aliases: []string{"verifypasswd", "verify"},
+	Short:   "verify user and password against the configuration",
+	Args:    cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := loadServerConfig()
+		if err != nil {
+			return err
+		}
+
+		if err := verifyCredentials(c.UpdaterHandler, args[0], args[1]); err != nil {
+			return err
+		}
+
+		fmt.Println("user and password are valid")
+		return nil
+	},
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"os"
 	"strings"
 	"testing"
+
+	"golang.org/x/crypto/argon2"
 )
 
 func TestArgonPasswordValidator(t *testing.T) {
@@ -31,6 +34,42 @@ func TestArgonPasswordValidator(t *testing.T) {
 	}
 }
 
+func TestVerifyCredentials(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	c := updaterHandlerConfig{
+		User: "dyndns",
+		Password: passwordConfig{
+			// Base64-RawURL of "secret-password" → "c2VjcmV0LXBhc3N3b3Jk"
+			Key:     argon2.IDKey([]byte("secret-password"), salt, 1, 64, 1, 32),
+			Salt:    salt,
+			Time:    1,
+			Memory:  64,
+			Threads: 1,
+			KeyLen:  32,
+		},
+	}
+
+	for _, testCase := range []struct {
+		name    string
+		user    string
+		passwd  string
+		wantErr error
+	}{
+		{"valid", "dyndns", "c2VjcmV0LXBhc3N3b3Jk", nil},
+		{"wrong user", "alice", "c2VjcmV0LXBhc3N3b3Jk", errUserMismatch},
+		{"padded base64", "dyndns", "c2VjcmV0LXBhc3N3b3Jk==", errPasswordDecode},
+		{"std base64 alphabet", "dyndns", "a+b/", errPasswordDecode},
+		{"wrong password", "dyndns", "d3JvbmctcGFzc3dvcmQ", errHashMismatch},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := verifyCredentials(c, testCase.user, testCase.passwd)
+			if !errors.Is(err, testCase.wantErr) {
+				t.Errorf("got error %v instead of %v", err, testCase.wantErr)
+			}
+		})
+	}
+}
+
 func TestGeneratePasswordCmd(t *testing.T) {
 	for _, testCase := range []struct {
 		name          string
@@ -73,7 +112,7 @@ func TestGeneratePasswordCmd(t *testing.T) {
 
 			saltLength = testCase.saltLength
 			passwdLength = testCase.passwdLength
-			time = testCase.time
+			argonTime = testCase.time
 			memory = testCase.memory
 			threads = testCase.threads
 			keyLen = testCase.keyLen
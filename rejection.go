@@ -1,33 +1,162 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"net/netip"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
 )
 
-// RejectBotsMiddleware short-circuits traffic that is obviously not a
-// Fritz!Box DynDNS update. A request is let through only if ALL of:
-// method is GET, path is "/", and the "user" query parameter is non-empty.
-// Everything else gets an empty 403 before the argon2id validation runs.
-func RejectBotsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			reject(w)
-			return
+// botRule describes requests that are let through to the updater. All of
+// its non-empty conditions must hold.
+type botRule struct {
+	// Methods allowed, e.g. GET.
+	Methods []string
+	// Paths are path.Match patterns, e.g. "/" or "/nic/*".
+	Paths []string
+	// Params and Headers must be present and non-empty.
+	Params  []string
+	Headers []string
+	// DenyUserAgents are regular expressions; a matching User-Agent header
+	// fails the rule.
+	DenyUserAgents []string
+	// CIDRs the client address must be in.
+	CIDRs []string
+	// Countries are ISO codes matched against CountryHeader, which must be
+	// set by a trusted reverse proxy, e.g. CF-IPCountry.
+	Countries     []string
+	CountryHeader string
+}
+
+// DEFAULT_BOT_RULES only let updates through: GET on "/" with a non-empty
+// user parameter, as sent by a Fritz!Box, or with host and sig for signed
+// updates.
+var DEFAULT_BOT_RULES = []botRule{
+	{
+		Methods: []string{http.MethodGet},
+		Paths:   []string{"/"},
+		Params:  []string{"user"},
+	},
+	{
+		Methods: []string{http.MethodGet},
+		Paths:   []string{"/"},
+		Params:  []string{"host", "sig"},
+	},
+}
+
+type compiledBotRule struct {
+	botRule
+	denyUserAgents []*regexp.Regexp
+	cidrs          []netip.Prefix
+}
+
+func (rule compiledBotRule) matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	if len(rule.Paths) > 0 && !slices.ContainsFunc(rule.Paths, func(pattern string) bool {
+		ok, _ := path.Match(pattern, r.URL.Path)
+		return ok
+	}) {
+		return false
+	}
+
+	query := r.URL.Query()
+	for _, p := range rule.Params {
+		if query.Get(p) == "" {
+			return false
+		}
+	}
+	for _, h := range rule.Headers {
+		if r.Header.Get(h) == "" {
+			return false
+		}
+	}
+
+	userAgent := r.UserAgent()
+	for _, re := range rule.denyUserAgents {
+		if re.MatchString(userAgent) {
+			return false
+		}
+	}
+
+	if len(rule.cidrs) > 0 {
+		addr, err := netip.ParseAddr(remoteHost(r))
+		if err != nil || !containsAddr(rule.cidrs, addr) {
+			return false
+		}
+	}
+	if len(rule.Countries) > 0 && !slices.ContainsFunc(rule.Countries, func(country string) bool {
+		return strings.EqualFold(country, r.Header.Get(rule.CountryHeader))
+	}) {
+		return false
+	}
+	return true
+}
+
+// botFilter short-circuits traffic that is obviously not a DynDNS update
+// before the argon2id validation runs.
+type botFilter struct {
+	rules []compiledBotRule
+}
+
+// newBotFilter compiles rules, or DEFAULT_BOT_RULES if there are none.
+func newBotFilter(rules []botRule) (*botFilter, error) {
+	if len(rules) == 0 {
+		rules = DEFAULT_BOT_RULES
+	}
+
+	f := &botFilter{}
+	for i, rule := range rules {
+		compiled := compiledBotRule{botRule: rule}
+		compiled.Methods = nil
+		for _, m := range rule.Methods {
+			compiled.Methods = append(compiled.Methods, strings.ToUpper(m))
+		}
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, fmt.Errorf("bot rule %d: invalid path pattern %q", i, pattern)
+			}
+		}
+		for _, pattern := range rule.DenyUserAgents {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("bot rule %d: invalid user agent pattern %q: %w", i, pattern, err)
+			}
+			compiled.denyUserAgents = append(compiled.denyUserAgents, re)
 		}
-		if r.URL.Path != "/" {
-			reject(w)
-			return
+		cidrs, err := parsePrefixes(rule.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("bot rule %d: %w", i, err)
 		}
-		if r.URL.Query().Get("user") == "" {
-			reject(w)
-			return
+		compiled.cidrs = cidrs
+		if len(rule.Countries) > 0 && rule.CountryHeader == "" {
+			return nil, fmt.Errorf("bot rule %d: countries require a country header", i)
 		}
+		f.rules = append(f.rules, compiled)
+	}
+	return f, nil
+}
 
-		next.ServeHTTP(w, r)
+// Middleware lets a request through if any rule matches. Everything else
+// gets an empty 403.
+func (f *botFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range f.rules {
+			if rule.matches(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		reject(w)
 	})
 }
 
 func reject(w http.ResponseWriter) {
+	rejectedBotsTotal.Inc("")
 	w.Header().Set("Content-Length", "0")
 	w.WriteHeader(http.StatusForbidden)
 }
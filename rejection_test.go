@@ -10,18 +10,28 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
-// TestRejectBotsMiddleware verifies the cheap pre-filter that keeps bot and
+// testDefaultBotFilter returns the filter with DEFAULT_BOT_RULES.
+func testDefaultBotFilter(t *testing.T) *botFilter {
+	t.Helper()
+	f, err := newBotFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// TestBotFilter_DefaultRules verifies the cheap pre-filter that keeps bot and
 // scanner traffic from triggering argon2id work and zonefile rewrites.
 //
 // A request reaches the next handler only if ALL of the following hold:
 //   - method is GET
 //   - path is exactly "/"
-//   - the "user" query parameter is non-empty
+//   - the "user" query parameter, or both "host" and "sig", are non-empty
 //
 // The User-Agent header is intentionally NOT checked here: any client
 // (curl, browser debugger, etc.) that satisfies the three cheap checks is
 // forwarded to the authoritative auth gate in updater.go.
-func TestRejectBotsMiddleware(t *testing.T) {
+func TestBotFilter_DefaultRules(t *testing.T) {
 	for _, testCase := range []struct {
 		name             string
 		method           string
@@ -39,6 +49,14 @@ func TestRejectBotsMiddleware(t *testing.T) {
 			expectedStatus:   http.StatusOK,
 			expectNextCalled: true,
 		},
+		{
+			name:             "signed request reaches next handler",
+			method:           "GET",
+			path:             "/",
+			query:            "?host=home&ts=1700000000&nonce=abc&sig=xyz",
+			expectedStatus:   http.StatusOK,
+			expectNextCalled: true,
+		},
 		{
 			name:            "non-GET rejected",
 			method:          "POST",
@@ -67,13 +85,13 @@ func TestRejectBotsMiddleware(t *testing.T) {
 		t.Run(testCase.name, func(t *testing.T) {
 			nextCalled := false
 			route := chi.NewRouter()
-			route.Use(RejectBotsMiddleware)
+			route.Use(testDefaultBotFilter(t).Middleware)
 			route.Get("/", func(w http.ResponseWriter, r *http.Request) {
 				nextCalled = true
 				w.WriteHeader(http.StatusOK)
 			})
 			route.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
-				t.Errorf("405 handler should not be reached; RejectBots must short-circuit first")
+				t.Errorf("405 handler should not be reached; the bot filter must short-circuit first")
 			})
 
 			req := httptest.NewRequest(testCase.method, testCase.path+testCase.query, nil)
@@ -101,12 +119,12 @@ func TestRejectBotsMiddleware(t *testing.T) {
 	}
 }
 
-// TestRejectBotsMiddleware_DoesNotPanicOnFlood pins the wire shape: even
+// TestBotFilter_DoesNotPanicOnFlood pins the wire shape: even
 // under flood, rejections stay 403 with an empty body and never leak the
 // password-error text.
-func TestRejectBotsMiddleware_DoesNotPanicOnFlood(t *testing.T) {
+func TestBotFilter_DoesNotPanicOnFlood(t *testing.T) {
 	route := chi.NewRouter()
-	route.Use(RejectBotsMiddleware)
+	route.Use(testDefaultBotFilter(t).Middleware)
 	route.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
@@ -124,3 +142,87 @@ func TestRejectBotsMiddleware_DoesNotPanicOnFlood(t *testing.T) {
 		}
 	}
 }
+
+func TestBotFilter(t *testing.T) {
+	rules := []botRule{
+		{
+			Methods:        []string{"get"},
+			Paths:          []string{"/nic/*"},
+			Params:         []string{"hostname"},
+			DenyUserAgents: []string{"(?i)curl"},
+		},
+		{
+			Methods:       []string{"POST"},
+			Headers:       []string{"Authorization"},
+			CIDRs:         []string{"192.0.2.0/24"},
+			Countries:     []string{"de"},
+			CountryHeader: "CF-IPCountry",
+		},
+	}
+
+	for _, testCase := range []struct {
+		name       string
+		method     string
+		target     string
+		remoteAddr string
+		headers    map[string]string
+		expectNext bool
+	}{
+		{"first rule", "GET", "/nic/update?hostname=home", "", nil, true},
+		{"path glob mismatch", "GET", "/?hostname=home", "", nil, false},
+		{"missing param", "GET", "/nic/update", "", nil, false},
+		{"denied user agent", "GET", "/nic/update?hostname=home", "", map[string]string{"User-Agent": "curl/8.0"}, false},
+		{"second rule", "POST", "/", "192.0.2.1:1234", map[string]string{"Authorization": "x", "CF-IPCountry": "DE"}, true},
+		{"outside cidr", "POST", "/", "198.51.100.1:1234", map[string]string{"Authorization": "x", "CF-IPCountry": "DE"}, false},
+		{"other country", "POST", "/", "192.0.2.1:1234", map[string]string{"Authorization": "x", "CF-IPCountry": "US"}, false},
+		{"missing header", "POST", "/", "192.0.2.1:1234", map[string]string{"CF-IPCountry": "DE"}, false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			f, err := newBotFilter(rules)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			nextCalled := false
+			handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+			}))
+
+			req := httptest.NewRequest(testCase.method, testCase.target, nil)
+			if testCase.remoteAddr != "" {
+				req.RemoteAddr = testCase.remoteAddr
+			}
+			for k, v := range testCase.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if nextCalled != testCase.expectNext {
+				t.Errorf("next handler called=%v, expected=%v", nextCalled, testCase.expectNext)
+			}
+			if !testCase.expectNext && w.Code != http.StatusForbidden {
+				t.Errorf("status code is %v instead of 403", w.Code)
+			}
+		})
+	}
+}
+
+func TestNewBotFilter_Invalid(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		rule        botRule
+		expectedErr string
+	}{
+		{"path pattern", botRule{Paths: []string{"/["}}, "bot rule 0: invalid path pattern"},
+		{"user agent", botRule{DenyUserAgents: []string{"("}}, "bot rule 0: invalid user agent pattern"},
+		{"cidr", botRule{CIDRs: []string{"nope"}}, "bot rule 0: invalid address or prefix"},
+		{"country without header", botRule{Countries: []string{"DE"}}, "countries require a country header"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := newBotFilter([]botRule{testCase.rule})
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+				t.Errorf("error is %v instead of %q", err, testCase.expectedErr)
+			}
+		})
+	}
+}
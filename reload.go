@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// CONFIG_FILE is read from the working directory by
+// hostsharing.ReadInConfig before any other location.
+const CONFIG_FILE = ".hostsharing-dyndns.conf"
+
+// serverState outlives a configuration, so a reload neither allows replays
+// of signed updates nor resets the rate limit of /ip and the watchdog. All
+// configurations publish under the same lock, and through the same backend
+// as long as its settings are unchanged.
+type serverState struct {
+	mu        sync.Mutex
+	nonces    *nonceCache
+	ipLimiter *rateLimiter
+	watchdog  *watchdogState
+
+	backend       zoneBackend
+	backendConfig backendConfig
+}
+
+// backendConfig are the settings of updaterHandlerConfig newZoneBackend
+// depends on.
+type backendConfig struct {
+	Backends  []string
+	Filename  string
+	RFC2136   rfc2136Config
+	StateFile string
+	Backups   int
+}
+
+func newServerState() *serverState {
+	return &serverState{
+		nonces:    newNonceCache(0),
+		ipLimiter: newRateLimiter(0, 0),
+		watchdog:  newWatchdogState(),
+	}
+}
+
+// zoneBackend returns the backend of the previous configuration if c did not
+// change it, so it keeps what it published, and a new one otherwise.
+func (st *serverState) zoneBackend(c updaterHandlerConfig) (zoneBackend, error) {
+	bc := backendConfig{c.Backends, c.Filename, c.RFC2136, c.StateFile, c.Backups}
+	if st.backend != nil && reflect.DeepEqual(bc, st.backendConfig) {
+		return st.backend, nil
+	}
+	b, err := newZoneBackend(c)
+	if err != nil {
+		return nil, err
+	}
+	st.backend, st.backendConfig = b, bc
+	return b, nil
+}
+
+// serverGeneration is everything setupServer built from one configuration.
+type serverGeneration struct {
+	*serverSetup
+	config *serverConfig
+	cancel context.CancelFunc
+}
+
+// reloader serves the handlers of the current configuration and replaces
+// them atomically once a new configuration passed validation.
+type reloader struct {
+	ctx     context.Context
+	load    func() (*serverConfig, error)
+	state   *serverState
+	mu      sync.Mutex
+	current atomic.Pointer[serverGeneration]
+}
+
+func newReloader(ctx context.Context, config *serverConfig, load func() (*serverConfig, error)) (*reloader, error) {
+	r := &reloader{ctx: ctx, load: load, state: newServerState()}
+	g, err := r.build(config)
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(g)
+	return r, nil
+}
+
+func (r *reloader) build(config *serverConfig) (*serverGeneration, error) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	setup, err := setupServer(ctx, config, r.state)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &serverGeneration{serverSetup: setup, config: config, cancel: cancel}, nil
+}
+
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.serve(w, req, func(g *serverGeneration) http.Handler { return g.handler })
+}
+
+// MTLSHandler serves the mtls listener with the current configuration.
+func (r *reloader) MTLSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.serve(w, req, func(g *serverGeneration) http.Handler { return g.mtls })
+	})
+}
+
+// serve passes the request to handler of the current generation. A
+// generation that is draining because Reload replaced it hands the request
+// on to its successor; only a draining current generation refuses it.
+func (r *reloader) serve(w http.ResponseWriter, req *http.Request, handler func(*serverGeneration) http.Handler) {
+	for {
+		g := r.current.Load()
+		if g.requests.serve(w, req, handler(g)) {
+			return
+		}
+		if r.current.Load() == g {
+			refuseDraining(w)
+			return
+		}
+	}
+}
+
+// Reload loads the configuration again and switches to it if it is valid.
+// Requests already running finish with the previous configuration. The
+// listeners are not restarted, so changes of Listen and MTLS other than
+// Names need a restart.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := r.load()
+	if err != nil {
+		return fmt.Errorf("keeping current configuration: %w", err)
+	}
+	next, err := r.build(config)
+	if err != nil {
+		return fmt.Errorf("keeping current configuration: %w", err)
+	}
+
+	prev := r.current.Load()
+	r.restore(next, prev)
+	r.current.Store(next)
+	mtls, prevMTLS := config.MTLS, prev.config.MTLS
+	mtls.Names, prevMTLS.Names = nil, nil
+	if !reflect.DeepEqual(config.Listen, prev.config.Listen) || !reflect.DeepEqual(mtls, prevMTLS) {
+		slog.Warn("listener settings changed, they take effect after a restart")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prev.config.Listen.ShutdownTimeout)
+	defer cancel()
+	if err := prev.shutdown(ctx); err != nil {
+		slog.Error("cannot finish updates of previous configuration", "err", err)
+	}
+	prev.cancel()
+
+	// Updates running during the switch were applied to the previous store.
+	r.restore(next, prev)
+	slog.Info("reloaded configuration")
+	return nil
+}
+
+// restore takes over the host states of prev, e.g. the time of the last
+// update, and then reads back what the backend published, which may have
+// changed in between, e.g. by a rollback.
+func (r *reloader) restore(next, prev *serverGeneration) {
+	next.store.Restore(prev.store.Hosts())
+	if err := next.store.Sync(); err != nil {
+		slog.Error("cannot read published records", "err", err)
+	}
+}
+
+// Shutdown waits for the updates of the current configuration.
+func (r *reloader) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g := r.current.Load()
+	defer g.cancel()
+	return g.shutdown(ctx)
+}
+
+// configFile returns the configuration file read by loadServerConfig.
+func configFile() string {
+	if _, err := os.Stat(CONFIG_FILE); err == nil {
+		return CONFIG_FILE
+	}
+	return viper.ConfigFileUsed()
+}
+
+// Watch calls Reload on SIGHUP and whenever filename changes, until ctx is
+// done. The directory is watched, as editors often replace the file. If it
+// cannot be watched, only SIGHUP triggers a reload.
+func (r *reloader) Watch(ctx context.Context, filename string) {
+	r.runWatch(ctx, r.watch(filename))
+}
+
+// configWatch are the sources of reloads set up by watch.
+type configWatch struct {
+	filename string
+	hup      chan os.Signal
+	watcher  *fsnotify.Watcher
+}
+
+// watch subscribes to SIGHUP and changes of filename. Both are in place
+// once it returns.
+func (r *reloader) watch(filename string) *configWatch {
+	w := &configWatch{filename: filename, hup: make(chan os.Signal, 1)}
+	signal.Notify(w.hup, syscall.SIGHUP)
+
+	watcher, err := watchDir(filename)
+	if err != nil {
+		slog.Error("cannot watch configuration, reload with SIGHUP instead", "file", filename, "err", err)
+		return w
+	}
+	w.watcher = watcher
+	return w
+}
+
+func (r *reloader) runWatch(ctx context.Context, w *configWatch) {
+	defer signal.Stop(w.hup)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if w.watcher != nil {
+		defer w.watcher.Close()
+		events, errs = w.watcher.Events, w.watcher.Errors
+	}
+
+	// Saving a file often causes several events in a row.
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	reload := func() {
+		if err := r.Reload(); err != nil {
+			slog.Error("cannot reload configuration", "err", err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.hup:
+			reload()
+		case e := <-events:
+			if filepath.Clean(e.Name) == filepath.Clean(w.filename) && (e.Has(fsnotify.Write) || e.Has(fsnotify.Create)) {
+				debounce.Reset(100 * time.Millisecond)
+			}
+		case err := <-errs:
+			slog.Error("cannot watch configuration", "err", err)
+		case <-debounce.C:
+			reload()
+		}
+	}
+}
+
+func watchDir(filename string) (*fsnotify.Watcher, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("no configuration file")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
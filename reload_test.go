@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	config := `
+UpdaterHandler:
+  User: alice
+  Filename: zone.txt
+  DomainSubpart: home
+  Password:
+    Key: AAECAwQFBgcICQoLDA0ODw==
+    Salt: AAECAwQFBgcICQoLDA0ODw==
+Metrics:
+  Enabled: false
+  Token: 0123456789abcdef
+`
+	withMetrics := strings.Replace(config, "Enabled: false", "Enabled: true", 1)
+	writeConfig := func(t *testing.T, yaml string) {
+		t.Helper()
+		if err := os.WriteFile(CONFIG_FILE, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer chdirTempConfig(t, config)()
+	c, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := newReloader(ctx, c, loadServerConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	metricsStatus := func() int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	// Without metrics, the bot filter of the updater answers.
+	if code := metricsStatus(); code == http.StatusOK {
+		t.Fatalf("metrics respond with %d before reload", code)
+	}
+
+	writeConfig(t, withMetrics)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code := metricsStatus(); code != http.StatusOK {
+		t.Errorf("metrics respond with %d after reload", code)
+	}
+
+	writeConfig(t, strings.Replace(withMetrics, "User: alice", `User: ""`, 1))
+	if err := r.Reload(); err == nil || !strings.Contains(err.Error(), "keeping current configuration") {
+		t.Errorf("error is %v for an invalid configuration", err)
+	}
+	if code := metricsStatus(); code != http.StatusOK {
+		t.Errorf("metrics respond with %d after invalid reload", code)
+	}
+
+	t.Run("watch", func(t *testing.T) {
+		go r.runWatch(ctx, r.watch(CONFIG_FILE))
+
+		writeConfig(t, config)
+		deadline := time.Now().Add(2 * time.Second)
+		for metricsStatus() == http.StatusOK {
+			if time.Now().After(deadline) {
+				t.Fatalf("configuration was not reloaded after the file changed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReloader_SyncsZonefile(t *testing.T) {
+	config := `
+UpdaterHandler:
+  User: alice
+  Filename: zone.txt
+  DomainSubpart: home
+  Password:
+    Key: AAECAwQFBgcICQoLDA0ODw==
+    Salt: AAECAwQFBgcICQoLDA0ODw==
+`
+	defer chdirTempConfig(t, config)()
+	c, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := newReloader(context.Background(), c, loadServerConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Shutdown(context.Background())
+
+	// Like the rollback command, replace the zonefile behind the server.
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := newFileBackend("zone.txt", newZonefile()).Publish(subdomain{"home", 120, &ipv4, nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h, _ := r.current.Load().store.Host("home")
+	if h.IPv4 == nil || *h.IPv4 != ipv4 || h.TTL != 120 {
+		t.Errorf("restored zonefile was not read on reload: %+v", h)
+	}
+}
+
+func TestReloader_KeepsState(t *testing.T) {
+	config := `
+UpdaterHandler:
+  User: alice
+  Filename: zone.txt
+  DomainSubpart: home
+  Password:
+    Key: AAECAwQFBgcICQoLDA0ODw==
+    Salt: AAECAwQFBgcICQoLDA0ODw==
+  Signing:
+    Secret: MDEyMzQ1Njc4OWFiY2RlZg==
+`
+	defer chdirTempConfig(t, config)()
+	c, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := newReloader(context.Background(), c, loadServerConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Shutdown(context.Background())
+
+	q := url.Values{}
+	q.Set("host", "home")
+	q.Set("ts", strconv.FormatInt(time.Now().Unix(), 10))
+	q.Set("nonce", "reload")
+	q.Set("ipaddr", "192.0.2.1")
+	q.Set("sig", signQuery([]byte("0123456789abcdef"), q))
+	update := func() int {
+		req := httptest.NewRequest("GET", "/?"+q.Encode(), nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := update(); code != http.StatusOK {
+		t.Fatalf("signed update responds with %d", code)
+	}
+	prev := r.current.Load()
+	before, _ := prev.store.Host("home")
+
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next := r.current.Load()
+
+	if code := update(); code != http.StatusUnauthorized {
+		t.Errorf("replayed update responds with %d after reload", code)
+	}
+	h, _ := next.store.Host("home")
+	if !h.UpdatedAt.Equal(before.UpdatedAt) || h.Client != "198.51.100.7" || h.IPv4 == nil || h.IPv4.String() != "192.0.2.1" {
+		t.Errorf("host state was not kept: %+v", h)
+	}
+	if next.store.backend != prev.store.backend || next.store.mu != prev.store.mu {
+		t.Errorf("unchanged backend is not shared with the previous configuration")
+	}
+}
+
+func TestReloader_HandsOffDrainingRequests(t *testing.T) {
+	defer chdirTempConfig(t, `
+UpdaterHandler:
+  User: alice
+  Filename: zone.txt
+  DomainSubpart: home
+  Password:
+    Key: AAECAwQFBgcICQoLDA0ODw==
+    Salt: AAECAwQFBgcICQoLDA0ODw==
+`)()
+	c, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := newReloader(context.Background(), c, loadServerConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Shutdown(context.Background())
+
+	prev := r.current.Load()
+	next, err := r.build(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer next.cancel()
+
+	// The request picks prev, which Reload replaces and drains before the
+	// request gets counted.
+	var served []*serverGeneration
+	w := httptest.NewRecorder()
+	r.serve(w, httptest.NewRequest("GET", "/ping", nil), func(g *serverGeneration) http.Handler {
+		if g == prev {
+			r.current.Store(next)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			prev.requests.Drain(ctx)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			served = append(served, g)
+			g.handler.ServeHTTP(w, req)
+		})
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("request picked up during reload responds with %d", w.Code)
+	}
+	if len(served) != 1 || served[0] != next {
+		t.Errorf("request was not served by the new configuration")
+	}
+
+	// Once the current configuration drains, requests are refused.
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("request after shutdown responds with %d", w.Code)
+	}
+}
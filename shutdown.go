@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// inflight counts running requests, so a shutdown can wait for updates that
+// are still writing the zonefile. This matters for FastCGI, whose server
+// cannot be shut down like an http.Server. Once draining, new requests are
+// refused with a 503.
+type inflight struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func (f *inflight) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.serve(w, r, next) {
+			refuseDraining(w)
+		}
+	})
+}
+
+// serve passes the request to next and counts it, unless draining already
+// started. It reports whether next was called.
+func (f *inflight) serve(w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+	f.mu.Lock()
+	if f.draining {
+		f.mu.Unlock()
+		return false
+	}
+	f.wg.Add(1)
+	f.mu.Unlock()
+	defer f.wg.Done()
+
+	next.ServeHTTP(w, r)
+	return true
+}
+
+func refuseDraining(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, "shutting down", http.StatusServiceUnavailable)
+}
+
+// Drain refuses new requests and waits for running ones until ctx is done.
+func (f *inflight) Drain(ctx context.Context) error {
+	f.mu.Lock()
+	f.draining = true
+	f.mu.Unlock()
+
+	return waitContext(ctx, f.wg.Wait)
+}
+
+// waitContext calls wait and returns early with the error of ctx if it is
+// done first.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForShutdown returns the error of the first server that stops on its
+// own. Once ctx is done or a server stopped cleanly, it calls shutdown
+// bounded by timeout.
+func waitForShutdown(ctx context.Context, errs <-chan error, shutdown func(context.Context) error, timeout time.Duration) error {
+	select {
+	case err := <-errs:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+	}
+
+	slog.Info("waiting for running updates", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := shutdown(shutdownCtx); err != nil {
+		slog.Error("cannot finish running updates", "err", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInflight_Drain(t *testing.T) {
+	requests := &inflight{}
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := requests.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("Ok"))
+	}))
+
+	running := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(running, httptest.NewRequest("GET", "/", nil))
+		close(finished)
+	}()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- requests.Drain(context.Background())
+	}()
+
+	// Drain sets draining before it waits, so poll until new requests are
+	// refused.
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := httptest.NewRecorder()
+		requests.Middleware(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new requests are not refused while draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-drained:
+		t.Fatalf("drain returned while a request was running")
+	default:
+	}
+
+	close(release)
+	<-finished
+	if err := <-drained; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if running.Body.String() != "Ok" {
+		t.Errorf("running request was not finished: %q", running.Body)
+	}
+}
+
+func TestInflight_DrainTimeout(t *testing.T) {
+	requests := &inflight{}
+	started := make(chan struct{})
+	handler := requests.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {}
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := requests.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error is %v instead of a timeout", err)
+	}
+}
+
+func TestWaitForShutdown(t *testing.T) {
+	serverErr := errors.New("address already in use")
+
+	for _, testCase := range []struct {
+		name             string
+		serverErr        error
+		cancel           bool
+		expectedErr      error
+		expectedShutdown bool
+	}{
+		{"signal", nil, true, nil, true},
+		{"server stopped", nil, false, nil, true},
+		{"server failed", serverErr, false, serverErr, false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := make(chan error, 1)
+			if testCase.cancel {
+				cancel()
+			} else {
+				errs <- testCase.serverErr
+			}
+
+			shutdownCalled := false
+			err := waitForShutdown(ctx, errs, func(ctx context.Context) error {
+				shutdownCalled = true
+				if _, ok := ctx.Deadline(); !ok {
+					t.Errorf("shutdown is not bounded")
+				}
+				return nil
+			}, time.Second)
+
+			if !errors.Is(err, testCase.expectedErr) {
+				t.Errorf("error is %v instead of %v", err, testCase.expectedErr)
+			}
+			if shutdownCalled != testCase.expectedShutdown {
+				t.Errorf("shutdown called=%v, expected=%v", shutdownCalled, testCase.expectedShutdown)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type signingConfig struct {
+	// Secret is shared with the client of DomainSubpart. Empty disables
+	// signed updates.
+	Secret []byte
+	// MaxSkew is how far ts may differ from the clock of the server.
+	MaxSkew time.Duration
+}
+
+// MAX_NONCE_LENGTH keeps clients from filling the nonce cache with large
+// values.
+const MAX_NONCE_LENGTH = 64
+
+// signQuery returns the base64url-encoded HMAC-SHA256 of all parameters of q
+// except sig. url.Values.Encode sorts them by key, so client and server
+// agree on the message regardless of the parameter order.
+func signQuery(secret []byte, q url.Values) string {
+	unsigned := url.Values{}
+	for key, values := range q {
+		if key != "sig" {
+			unsigned[key] = values
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers nonces of signed requests as long as their timestamp
+// is accepted, so each request can only be used once.
+type nonceCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+	now  func() time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, seen: map[string]time.Time{}, now: time.Now}
+}
+
+// SetTTL changes how long nonces are kept, e.g. after a reload changed
+// MaxSkew. Nonces already seen are kept.
+func (c *nonceCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+// Add records nonce and reports whether it was not seen before.
+func (c *nonceCache) Add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for n, added := range c.seen {
+		if now.Sub(added) > c.ttl {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// SignatureValidationMiddleware authenticates updates signed with
+// signQuery as an alternative to user and password. The signature is
+// checked before the nonce is recorded, so unsigned requests cannot fill
+// the cache. A timestamp may be off by maxSkew in either direction, so
+// nonces must be kept for twice as long.
+func SignatureValidationMiddleware(host string, secret []byte, maxSkew time.Duration, nonces *nonceCache) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+
+			if len(secret) == 0 || !hmac.Equal([]byte(q.Get("sig")), []byte(signQuery(secret, q))) || q.Get("host") != host {
+				rejectCredentials(w)
+				return
+			}
+
+			ts, err := strconv.ParseInt(q.Get("ts"), 10, 64)
+			if err != nil {
+				authFailuresTotal.Inc("")
+				http.Error(w, "ts is incorrect", http.StatusUnauthorized)
+				return
+			}
+			if skew := nonces.now().Sub(time.Unix(ts, 0)); skew > maxSkew || skew < -maxSkew {
+				authFailuresTotal.Inc("")
+				http.Error(w, "ts is out of range", http.StatusUnauthorized)
+				return
+			}
+
+			nonce := q.Get("nonce")
+			if nonce == "" || len(nonce) > MAX_NONCE_LENGTH {
+				authFailuresTotal.Inc("")
+				http.Error(w, "nonce is incorrect", http.StatusUnauthorized)
+				return
+			}
+			if !nonces.Add(nonce) {
+				authFailuresTotal.Inc("")
+				http.Error(w, "nonce was already used", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignQuery(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	q, _ := url.ParseQuery("host=home&ts=1700000000&nonce=abc&ipaddr=192.0.2.1")
+	reordered, _ := url.ParseQuery("ipaddr=192.0.2.1&nonce=abc&ts=1700000000&host=home&sig=ignored")
+
+	if signQuery(secret, q) != signQuery(secret, reordered) {
+		t.Errorf("signature depends on parameter order or sig")
+	}
+	if signQuery(secret, q) == signQuery([]byte("fedcba9876543210"), q) {
+		t.Errorf("signature does not depend on the secret")
+	}
+	q.Set("ipaddr", "192.0.2.2")
+	if signQuery(secret, q) == signQuery(secret, reordered) {
+		t.Errorf("signature does not depend on the parameters")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Now()
+	c := newNonceCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	if !c.Add("a") {
+		t.Fatalf("new nonce was rejected")
+	}
+	if c.Add("a") {
+		t.Fatalf("nonce was accepted twice")
+	}
+	now = now.Add(2 * time.Minute)
+	if !c.Add("a") {
+		t.Errorf("expired nonce was rejected")
+	}
+	if len(c.seen) != 1 {
+		t.Errorf("cache holds %d nonces instead of 1", len(c.seen))
+	}
+}
+
+func TestSignatureValidationMiddleware(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+	signed := func(secret []byte, host string, ts time.Time, nonce string) string {
+		q := url.Values{}
+		q.Set("host", host)
+		q.Set("ts", strconv.FormatInt(ts.Unix(), 10))
+		q.Set("nonce", nonce)
+		q.Set("ipaddr", "192.0.2.1")
+		q.Set("sig", signQuery(secret, q))
+		return "/?" + q.Encode()
+	}
+
+	for _, testCase := range []struct {
+		name               string
+		secret             []byte
+		targets            []string
+		expectedStatusCode int
+	}{
+		{"valid", secret, []string{signed(secret, "home", now, "a")}, 200},
+		{"skewed", secret, []string{signed(secret, "home", now.Add(-4*time.Minute), "a")}, 200},
+		{"wrong secret", secret, []string{signed([]byte("fedcba9876543210"), "home", now, "a")}, 401},
+		{"other host", secret, []string{signed(secret, "work", now, "a")}, 401},
+		{"stale", secret, []string{signed(secret, "home", now.Add(-6*time.Minute), "a")}, 401},
+		{"future", secret, []string{signed(secret, "home", now.Add(6*time.Minute), "a")}, 401},
+		{"missing nonce", secret, []string{signed(secret, "home", now, "")}, 401},
+		{"replay", secret, []string{signed(secret, "home", now, "a"), signed(secret, "home", now, "a")}, 401},
+		{"tampered", secret, []string{signed(secret, "home", now, "a") + "&ip6addr=2001:db8::1"}, 401},
+		{"signing disabled", nil, []string{signed(nil, "home", now, "a")}, 401},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			nonces := newNonceCache(10 * time.Minute)
+			nonces.now = func() time.Time { return now }
+			handler := SignatureValidationMiddleware("home", testCase.secret, 5*time.Minute, nonces)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Ok"))
+			}))
+
+			var w *httptest.ResponseRecorder
+			for _, target := range testCase.targets {
+				w = httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			}
+			if w.Code != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v: %s", w.Code, testCase.expectedStatusCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestUpdateClient_Signed(t *testing.T) {
+	store := newZoneStore(testMemoryBackend(t, ""), "home")
+	c := updaterHandlerConfig{
+		User:          "dyndns",
+		DomainSubpart: "home",
+		Signing:       signingConfig{Secret: []byte("0123456789abcdef"), MaxSkew: time.Minute},
+	}
+	updater := httptest.NewServer(testDefaultBotFilter(t).Middleware(updaterHandler(c, store, newNonceCache(2*time.Minute), testAccessRules(c))))
+	defer updater.Close()
+
+	u := newUpdateClient(clientConfig{URL: updater.URL + "/", Host: "home", Secret: []byte("0123456789abcdef"), IPv4: true})
+	ipv4 := netip.MustParseAddr("192.0.2.1")
+	for range 2 {
+		if err := u.update(context.Background(), &ipv4, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	h, _ := store.Host("home")
+	if h.IPv4 == nil || *h.IPv4 != ipv4 {
+		t.Errorf("published address is %v instead of %v", h.IPv4, ipv4)
+	}
+}
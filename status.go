@@ -0,0 +1,78 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const STATUS_TEMPLATE = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>hostsharing-dyndns status</title></head>
+<body>
+<table>
+<tr><th>Host</th><th>A</th><th>AAAA</th><th>TTL</th><th>Last update</th><th>Last client</th></tr>
+{{- range . }}
+<tr><td>{{ .Name }}</td><td>{{ with .IPv4 }}{{ . }}{{ end }}</td><td>{{ with .IPv6 }}{{ . }}{{ end }}</td><td>{{ .TTL }}</td><td>{{ if not .UpdatedAt.IsZero }}{{ .UpdatedAt.UTC.Format "2006-01-02 15:04:05 UTC" }}{{ end }}</td><td>{{ .Client }}</td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`
+
+var statusTemplate = template.Must(template.New("Status").Parse(STATUS_TEMPLATE))
+
+// prefersJSON reports whether the Accept header of r ranks application/json
+// above text/html. Without a preference the HTML page is served.
+func prefersJSON(r *http.Request) bool {
+	htmlQ, jsonQ := -1.0, -1.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+func StatusHandler(s *zoneStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if prefersJSON(r) {
+			writeJSON(w, http.StatusOK, s.Hosts())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, s.Hosts()); err != nil {
+			slog.Error("cannot render status page", "err", err)
+		}
+	}
+}
+
+// statusHandler serves a read-only overview of the published records. It is
+// meant to be mounted at /status and uses the same credentials as the API.
+func statusHandler(c updaterHandlerConfig, s *zoneStore, access accessRules) http.Handler {
+	route := chi.NewRouter()
+	route.Use(ClientAllowlistMiddleware(access.allowed))
+	route.Use(BasicAuthMiddleware(c.User, access.validate))
+	route.Get("/", StatusHandler(s))
+	return route
+}
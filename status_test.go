@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefersJSON(t *testing.T) {
+	for _, testCase := range []struct {
+		accept   string
+		expected bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html", false},
+		{"application/json", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json, text/html;q=0.5", true},
+		{"application/json;q=0.5, text/html", false},
+		{"application/json;q=invalid", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", testCase.accept)
+		if got := prefersJSON(r); got != testCase.expected {
+			t.Errorf("prefersJSON(%q) = %v instead of %v", testCase.accept, got, testCase.expected)
+		}
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+
+	s := newZoneStore(newFileBackend(filepath.Join(t.TempDir(), "zone.txt"), newZonefile()), "home")
+	if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4, IPv6: &ipv6, Client: "198.51.100.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("html", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		StatusHandler(s)(w, httptest.NewRequest("GET", "/", nil))
+
+		if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("content type is %q instead of text/html", ct)
+		}
+		for _, want := range []string{"<td>home</td>", "<td>192.168.1.1</td>", "<td>2001:db8::1</td>", "<td>60</td>", "<td>198.51.100.7</td>", " UTC</td>"} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("status page is missing %q: %s", want, w.Body)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		StatusHandler(s)(w, r)
+
+		if ct := w.Result().Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type is %q instead of application/json", ct)
+		}
+		var hosts []hostState
+		if err := json.NewDecoder(w.Body).Decode(&hosts); err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 1 || hosts[0].Name != "home" || *hosts[0].IPv4 != ipv4 || *hosts[0].IPv6 != ipv6 || hosts[0].Client != "198.51.100.7" || hosts[0].UpdatedAt.IsZero() {
+			t.Errorf("unexpected status: %+v", hosts)
+		}
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		StatusHandler(s)(w, httptest.NewRequest("GET", "/", nil))
+		if w.Result().Header.Get("Vary") != "Accept" {
+			t.Errorf("response does not vary on Accept")
+		}
+	})
+}
+
+func TestStatusHandler_RemoteClient(t *testing.T) {
+	c := testUpdaterConfig(t)
+	s := newZoneStore(newFileBackend(c.Filename, newZonefile()), c.DomainSubpart)
+
+	r := httptest.NewRequest("GET", "/?user=dyndns&passwd=c2VjcmV0LXBhc3N3b3Jk&ipaddr=192.168.1.1", nil)
+	r.RemoteAddr = "198.51.100.7:41234"
+	w := httptest.NewRecorder()
+	updaterHandler(c, s, newNonceCache(0), testAccessRules(c)).ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("status code is %v instead of %v", w.Result().StatusCode, http.StatusOK)
+	}
+
+	h, _ := s.Host("home")
+	if h.Client != "198.51.100.7" {
+		t.Errorf("last client is %q instead of %q", h.Client, "198.51.100.7")
+	}
+}
+
+func TestStatusHandler_AllowedClients(t *testing.T) {
+	c := testUpdaterConfig(t)
+	c.AllowedClients = []string{"192.0.2.0/24"}
+	handler := statusHandler(c, newZoneStore(newFileBackend(c.Filename, newZonefile()), c.DomainSubpart), testAccessRules(c))
+
+	for _, testCase := range []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"198.51.100.1:1234", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = testCase.remoteAddr
+		r.SetBasicAuth("dyndns", "c2VjcmV0LXBhc3N3b3Jk")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != testCase.expectedStatus {
+			t.Errorf("%s: status code is %v instead of %v", testCase.remoteAddr, w.Result().StatusCode, testCase.expectedStatus)
+		}
+	}
+}
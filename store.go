@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hostState is the record set last published for a managed host.
+type hostState struct {
+	Name      string      `json:"name"`
+	TTL       uint        `json:"ttl"`
+	IPv4      *netip.Addr `json:"ipv4"`
+	IPv6      *netip.Addr `json:"ipv6"`
+	UpdatedAt time.Time   `json:"updatedAt,omitzero"`
+	Client    string      `json:"client,omitempty"`
+}
+
+// changeListener is called after an update changed the addresses of a host.
+// It runs while the store is locked and must not block.
+type changeListener func(prev, h hostState)
+
+// writeListener is called after Apply changed the published records, e.g.
+// the content of the zonefile. It runs while the store is locked and must
+// not block.
+type writeListener func(h hostState)
+
+// zoneBackend publishes the records of a host where resolvers pick them up.
+type zoneBackend interface {
+	// Publish replaces the published records of s.Subpart with s and
+	// reports whether that changed anything.
+	Publish(s subdomain) (bool, error)
+}
+
+// zoneLoader is implemented by backends that can read back the records they
+// published.
+type zoneLoader interface {
+	Load(name string) (subdomain, error)
+}
+
+// newZoneBackend returns the backend for each name in c.Backends, or the
+// file backend if none is configured. Several backends are combined, e.g.
+// to keep the zonefile while migrating to dynamic updates.
+func newZoneBackend(c updaterHandlerConfig) (zoneBackend, error) {
+	names := c.Backends
+	if len(names) == 0 {
+		names = []string{"file"}
+	}
+
+	backends := multiBackend{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate backend %q", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "file":
+			b := newFileBackend(c.Filename, newZonefile())
+			b.backups = c.Backups
+			backends = append(backends, b)
+		case "rfc2136":
+			backends = append(backends, newDNSUpdateBackend(c.RFC2136))
+		case "memory":
+			b, err := newMemoryBackend(c.StateFile)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, b)
+		default:
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+	}
+
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	return backends, nil
+}
+
+// multiBackend publishes to all of its backends. A failing backend does not
+// keep the others from publishing; its error is returned together with
+// whether any backend changed.
+type multiBackend []zoneBackend
+
+func (m multiBackend) Publish(s subdomain) (bool, error) {
+	changed := false
+	errs := []error{}
+	for _, b := range m {
+		c, err := b.Publish(s)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		changed = changed || c
+	}
+	return changed, errors.Join(errs...)
+}
+
+// Load reads from the first backend that has published records of name.
+func (m multiBackend) Load(name string) (subdomain, error) {
+	for _, b := range m {
+		l, ok := b.(zoneLoader)
+		if !ok {
+			continue
+		}
+		s, err := l.Load(name)
+		if err != nil {
+			return subdomain{}, err
+		}
+		if s.IPv4 != nil || s.IPv6 != nil {
+			return s, nil
+		}
+	}
+	return subdomain{Subpart: name}, nil
+}
+
+// zoneStore serializes updates coming from the updater and the API and
+// remembers what was published last for each managed host.
+type zoneStore struct {
+	// mu may be shared with the stores of other configurations, so their
+	// updates do not interleave during a reload.
+	mu             *sync.Mutex
+	backend        zoneBackend
+	hosts          map[string]hostState
+	listeners      []changeListener
+	writeListeners []writeListener
+}
+
+func newZoneStore(b zoneBackend, names ...string) *zoneStore {
+	s := &zoneStore{mu: &sync.Mutex{}, backend: b, hosts: map[string]hostState{}}
+	for _, name := range names {
+		s.hosts[name] = hostState{Name: name, TTL: 60}
+	}
+	return s
+}
+
+// OnChange registers l to be called whenever Apply changed the addresses of
+// a host.
+func (s *zoneStore) OnChange(l changeListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listeners = append(s.listeners, l)
+}
+
+// OnWrite registers l to be called whenever Apply changed the content of
+// the zonefile.
+func (s *zoneStore) OnWrite(l writeListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeListeners = append(s.writeListeners, l)
+}
+
+// Host returns the state of name and whether name is managed by the store.
+func (s *zoneStore) Host(name string) (hostState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.hosts[name]
+	return h, ok
+}
+
+// Hosts returns the state of all managed hosts ordered by name.
+func (s *zoneStore) Hosts() []hostState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hosts := make([]hostState, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+// Apply publishes the addresses of h and returns the state that was
+// replaced. h.Name must be a managed host.
+func (s *zoneStore) Apply(h hostState) (hostState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.hosts[h.Name]
+	if !ok {
+		return hostState{}, fmt.Errorf("unknown host %q", h.Name)
+	}
+
+	written, err := s.backend.Publish(subdomain{
+		Subpart: h.Name,
+		TTL:     h.TTL,
+		IPv4:    h.IPv4,
+		IPv6:    h.IPv6,
+	})
+	if err != nil {
+		// Some backends may have published anyway and will report no
+		// change when the update is retried, so tell listeners now.
+		if written {
+			for _, l := range s.writeListeners {
+				l(h)
+			}
+		}
+		return prev, err
+	}
+
+	h.UpdatedAt = time.Now()
+	s.hosts[h.Name] = h
+
+	if h.addressChanged(prev) {
+		for _, l := range s.listeners {
+			l(prev, h)
+		}
+	}
+	if written {
+		for _, l := range s.writeListeners {
+			l(h)
+		}
+	}
+	return prev, nil
+}
+
+// Sync replaces the addresses of all hosts with what the backend has
+// published, e.g. after a restart or a rollback. It does nothing if the
+// backend cannot read back its records and does not notify listeners.
+func (s *zoneStore) Sync() error {
+	l, ok := s.backend.(zoneLoader)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, h := range s.hosts {
+		published, err := l.Load(name)
+		if err != nil {
+			return err
+		}
+		h.IPv4, h.IPv6 = published.IPv4, published.IPv6
+		if published.TTL > 0 {
+			h.TTL = published.TTL
+		}
+		s.hosts[name] = h
+	}
+	return nil
+}
+
+// Restore takes over the state of the hosts in prev that is newer than its
+// own, e.g. from the store of the previous configuration. Hosts that are no
+// longer managed are ignored and listeners are not notified.
+func (s *zoneStore) Restore(prev []hostState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range prev {
+		if h, ok := s.hosts[p.Name]; ok && p.UpdatedAt.After(h.UpdatedAt) {
+			s.hosts[p.Name] = p
+		}
+	}
+}
+
+// Delete removes all published address records of name.
+func (s *zoneStore) Delete(name string) error {
+	h, ok := s.Host(name)
+	if !ok {
+		return fmt.Errorf("unknown host %q", name)
+	}
+	h.IPv4, h.IPv6 = nil, nil
+	_, err := s.Apply(h)
+	return err
+}
+
+func sameAddr(a, b *netip.Addr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// addressChanged reports whether the addresses of h differ from prev.
+func (h hostState) addressChanged(prev hostState) bool {
+	return !sameAddr(h.IPv4, prev.IPv4) || !sameAddr(h.IPv6, prev.IPv6)
+}
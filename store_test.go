@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZoneStore(t *testing.T) {
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	path := filepath.Join(t.TempDir(), "zone.txt")
+
+	s := newZoneStore(newFileBackend(path, newZonefile()), "home")
+
+	if _, ok := s.Host("home"); !ok {
+		t.Fatalf("configured host is not managed by the store")
+	}
+	if _, err := s.Apply(hostState{Name: "office", TTL: 60, IPv4: &ipv4}); err == nil {
+		t.Errorf("expected error for unknown host")
+	}
+
+	if _, err := s.Apply(hostState{Name: "home", TTL: 120, IPv4: &ipv4, IPv6: &ipv6}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h, _ := s.Host("home")
+	if *h.IPv4 != ipv4 || *h.IPv6 != ipv6 || h.TTL != 120 {
+		t.Errorf("state does not reflect the update: %+v", h)
+	}
+	if h.UpdatedAt.IsZero() {
+		t.Errorf("update time was not recorded")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "home.{DOM_HOSTNAME}. 120 IN A 192.168.1.1") {
+		t.Errorf("zonefile is missing the A record: %q", got)
+	}
+
+	if err := s.Delete("home"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h, _ = s.Host("home")
+	if h.IPv4 != nil || h.IPv6 != nil {
+		t.Errorf("addresses survived delete: %+v", h)
+	}
+	got, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), " IN ") {
+		t.Errorf("zonefile still contains records: %q", got)
+	}
+
+	if hosts := s.Hosts(); len(hosts) != 1 || hosts[0].Name != "home" {
+		t.Errorf("unexpected hosts: %+v", hosts)
+	}
+}
+
+func TestHostStateAddressChanged(t *testing.T) {
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	otherIPv4 := netip.MustParseAddr("192.168.1.2")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+
+	for _, testCase := range []struct {
+		name     string
+		h, prev  hostState
+		expected bool
+	}{
+		{"both empty", hostState{}, hostState{}, false},
+		{"same", hostState{IPv4: &ipv4, IPv6: &ipv6}, hostState{IPv4: &ipv4, IPv6: &ipv6}, false},
+		{"same but ttl", hostState{IPv4: &ipv4, TTL: 60}, hostState{IPv4: &ipv4, TTL: 120}, false},
+		{"new v4", hostState{IPv4: &otherIPv4}, hostState{IPv4: &ipv4}, true},
+		{"v6 added", hostState{IPv4: &ipv4, IPv6: &ipv6}, hostState{IPv4: &ipv4}, true},
+		{"v6 removed", hostState{IPv4: &ipv4}, hostState{IPv4: &ipv4, IPv6: &ipv6}, true},
+	} {
+		if got := testCase.h.addressChanged(testCase.prev); got != testCase.expected {
+			t.Errorf("%s: addressChanged is %v instead of %v", testCase.name, got, testCase.expected)
+		}
+	}
+}
+
+func TestZoneStore_SkipsUnchangedContent(t *testing.T) {
+	path := freshTempWithStale(t, []byte("home.{DOM_HOSTNAME}. 60 IN A 10.0.0.99\n"))
+	s := newZoneStore(newFileBackend(path, newZonefile()), "home")
+
+	writes := 0
+	s.OnWrite(func(h hostState) { writes++ })
+
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	for range 2 {
+		if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if writes != 1 {
+		t.Errorf("zonefile was written %d times instead of once", writes)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), "10.0.0.99") {
+		t.Errorf("stale content was not replaced: %q", got)
+	}
+}
+
+type fakeBackend struct {
+	changed   bool
+	err       error
+	published []subdomain
+}
+
+func (b *fakeBackend) Publish(s subdomain) (bool, error) {
+	b.published = append(b.published, s)
+	return b.changed, b.err
+}
+
+func TestMultiBackend(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		backends        []*fakeBackend
+		expectedChanged bool
+		expectedErr     bool
+	}{
+		{"all unchanged", []*fakeBackend{{}, {}}, false, false},
+		{"one changed", []*fakeBackend{{}, {changed: true}}, true, false},
+		{"one failed", []*fakeBackend{{err: fmt.Errorf("down")}, {changed: true}}, true, true},
+		{"all failed", []*fakeBackend{{err: fmt.Errorf("down")}, {err: fmt.Errorf("down")}}, false, true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := multiBackend{}
+			for _, b := range testCase.backends {
+				m = append(m, b)
+			}
+
+			changed, err := m.Publish(subdomain{Subpart: "home", TTL: 60})
+			if changed != testCase.expectedChanged {
+				t.Errorf("changed is %v instead of %v", changed, testCase.expectedChanged)
+			}
+			if (err != nil) != testCase.expectedErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			for i, b := range testCase.backends {
+				if len(b.published) != 1 {
+					t.Errorf("backend %d was published to %d times instead of once", i, len(b.published))
+				}
+			}
+		})
+	}
+}
+
+func TestNewZoneBackend(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		backends []string
+		expected string
+	}{
+		{"default", nil, "*main.fileBackend"},
+		{"file", []string{"file"}, "*main.fileBackend"},
+		{"rfc2136", []string{"rfc2136"}, "*main.dnsUpdateBackend"},
+		{"memory", []string{"memory"}, "*main.memoryBackend"},
+		{"memory and file", []string{"memory", "file"}, "main.multiBackend"},
+		{"both", []string{"file", "rfc2136"}, "main.multiBackend"},
+		{"duplicate", []string{"file", "file"}, ""},
+		{"unknown", []string{"s3"}, ""},
+	} {
+		b, err := newZoneBackend(updaterHandlerConfig{Filename: "zone.txt", Backends: testCase.backends})
+		if testCase.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", testCase.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testCase.name, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", b); got != testCase.expected {
+			t.Errorf("%s: backend is %s instead of %s", testCase.name, got, testCase.expected)
+		}
+	}
+}
+
+func TestZoneStore_PartialFailure(t *testing.T) {
+	failing := &fakeBackend{err: fmt.Errorf("down")}
+	s := newZoneStore(multiBackend{&fakeBackend{changed: true}, failing}, "home")
+
+	writes := 0
+	s.OnWrite(func(h hostState) { writes++ })
+
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err == nil {
+		t.Fatalf("expected error from failing backend")
+	}
+	if writes != 1 {
+		t.Errorf("write listeners were called %d times instead of once", writes)
+	}
+	if h, _ := s.Host("home"); h.IPv4 != nil {
+		t.Errorf("state was updated although a backend failed: %+v", h)
+	}
+}
+
+func TestZoneStore_Sync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone.txt")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := newFileBackend(path, newZonefile()).Publish(subdomain{"home", 120, &ipv4, nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newZoneStore(multiBackend{testMemoryBackend(t, ""), newFileBackend(path, newZonefile())}, "home")
+	changes := 0
+	s.OnChange(func(prev, h hostState) { changes++ })
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, _ := s.Host("home")
+	if h.IPv4 == nil || *h.IPv4 != ipv4 || h.TTL != 120 {
+		t.Errorf("state was not loaded from the zonefile: %+v", h)
+	}
+	if changes != 0 {
+		t.Errorf("sync notified %d change listeners", changes)
+	}
+
+	if err := newZoneStore(testMemoryBackend(t, ""), "home").Sync(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestZoneStore_Restore(t *testing.T) {
+	s := newZoneStore(&fakeBackend{changed: true}, "home", "office")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := s.Apply(hostState{Name: "office", TTL: 60, IPv4: &ipv4}); err != nil {
+		t.Fatal(err)
+	}
+	office, _ := s.Host("office")
+
+	changes := 0
+	s.OnChange(func(prev, h hostState) { changes++ })
+	older := netip.MustParseAddr("192.168.1.2")
+	updatedAt := time.Now().Add(-time.Hour)
+	s.Restore([]hostState{
+		{Name: "home", TTL: 120, IPv4: &ipv4, UpdatedAt: updatedAt, Client: "198.51.100.7"},
+		{Name: "office", TTL: 60, IPv4: &older, UpdatedAt: updatedAt},
+		{Name: "other", TTL: 60, IPv4: &ipv4, UpdatedAt: updatedAt},
+	})
+
+	if h, _ := s.Host("home"); h.IPv4 == nil || *h.IPv4 != ipv4 || !h.UpdatedAt.Equal(updatedAt) || h.Client != "198.51.100.7" {
+		t.Errorf("newer state was not restored: %+v", h)
+	}
+	if h, _ := s.Host("office"); h.IPv4 == nil || *h.IPv4 != ipv4 || !h.UpdatedAt.Equal(office.UpdatedAt) {
+		t.Errorf("older state replaced the current one: %+v", h)
+	}
+	if _, ok := s.Host("other"); ok {
+		t.Errorf("unmanaged host was restored")
+	}
+	if changes != 0 {
+		t.Errorf("restore notified %d change listeners", changes)
+	}
+}
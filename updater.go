@@ -6,9 +6,10 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/netip"
-	"os"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog/v2"
@@ -32,29 +33,70 @@ type updaterHandlerConfig struct {
 	Password      passwordConfig
 	Filename      string
 	DomainSubpart string
+	MaxAge        time.Duration
+	// Backends selects where records are published: "file" (default) writes
+	// Filename, "rfc2136" sends dynamic updates as configured in RFC2136 and
+	// "memory" only keeps them for the serveDNS command. Several backends
+	// are updated together.
+	Backends []string
+	RFC2136  rfc2136Config
+	// StateFile is where the memory backend keeps its records, so they
+	// survive a restart.
+	StateFile string
+	// Backups is the number of previous zonefile versions kept next to
+	// Filename for the rollback command.
+	Backups int
+	// AllowedClients are addresses or prefixes the user may update from.
+	// Requests from anywhere else are refused before the password is
+	// checked. Empty allows every client.
+	AllowedClients []string
+	// RequireSourceMatch refuses updates of DomainSubpart whose ipaddr or
+	// ip6addr of the connection's family is not the client address.
+	RequireSourceMatch bool
+	// Signing allows updates signed with a shared secret instead of the
+	// password, which cannot be replayed from a log.
+	Signing signingConfig
 }
 
 var ctxIPv4Key = ctxIPKey{uint8: 0}
 var ctxIPv6Key = ctxIPKey{uint8: 1}
 
+// remoteHost returns the address of the client without the port as
+// resolved by ClientAddrMiddleware.
+func remoteHost(r *http.Request) string {
+	if addr, ok := r.Context().Value(ctxClientAddrKey{}).(netip.Addr); ok {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func rejectCredentials(w http.ResponseWriter) {
+	authFailuresTotal.Inc("")
+	http.Error(w, "user or password wrong", http.StatusUnauthorized)
+}
+
 func PasswordValidationMiddleware(validate passwordValidator) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passwd := r.URL.Query().Get("passwd")
 
 			if passwd == "" {
-				http.Error(w, "user or password wrong", http.StatusUnauthorized)
+				rejectCredentials(w)
 				return
 			}
 
 			decodedPasswd, err := base64.RawURLEncoding.DecodeString(passwd)
 			if err != nil {
-				http.Error(w, "user or password wrong", http.StatusUnauthorized)
+				rejectCredentials(w)
 				return
 			}
 
 			if !validate(decodedPasswd) {
-				http.Error(w, "user or password wrong", http.StatusUnauthorized)
+				rejectCredentials(w)
 				return
 			}
 
@@ -63,18 +105,49 @@ func PasswordValidationMiddleware(validate passwordValidator) func(next http.Han
 	}
 }
 
-func UserValidationMiddleware(user string) func(next http.Handler) http.Handler {
+// UserValidationMiddleware rejects requests for any user other than user.
+// A correct user proceeds to the argon2id check in
+// PasswordValidationMiddleware, so a rejected user runs the same decode and
+// validate steps and discards the result. Otherwise the response time would
+// reveal whether a username exists.
+func UserValidationMiddleware(user string, validate passwordValidator) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			unverifiedUser := r.URL.Query().Get("user")
 
-			if unverifiedUser == "" {
-				http.Error(w, "user or password wrong", http.StatusUnauthorized)
+			if subtle.ConstantTimeCompare([]byte(user), []byte(unverifiedUser)) != 1 || unverifiedUser == "" {
+				if passwd := r.URL.Query().Get("passwd"); passwd != "" {
+					if decodedPasswd, err := base64.RawURLEncoding.DecodeString(passwd); err == nil {
+						validate(decodedPasswd)
+					}
+				}
+				rejectCredentials(w)
 				return
 			}
 
-			if subtle.ConstantTimeCompare([]byte(user), []byte(unverifiedUser)) != 1 {
-				http.Error(w, "user or password wrong", http.StatusUnauthorized)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rejectClient(w http.ResponseWriter) {
+	authFailuresTotal.Inc("")
+	http.Error(w, "client address not allowed", http.StatusForbidden)
+}
+
+// ClientAllowlistMiddleware refuses clients outside allowed, so they cannot
+// trigger argon2id work. An empty allowlist allows every client.
+func ClientAllowlistMiddleware(allowed []netip.Prefix) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(allowed) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			addr, err := netip.ParseAddr(remoteHost(r))
+			if err != nil || !containsAddr(allowed, addr) {
+				rejectClient(w)
 				return
 			}
 
@@ -83,6 +156,33 @@ func UserValidationMiddleware(user string) func(next http.Handler) http.Handler
 	}
 }
 
+// SourceMatchMiddleware refuses updates whose address from
+// IPValidationMiddleware of the family the client connects with is not the
+// client address. The address of the other family cannot be checked and is
+// passed through.
+func SourceMatchMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(remoteHost(r))
+		if err != nil {
+			http.Error(w, "cannot determine client address", http.StatusBadRequest)
+			return
+		}
+		addr = addr.Unmap()
+
+		key, param := ctxIPv4Key, "ipaddr"
+		if addr.Is6() {
+			key, param = ctxIPv6Key, "ip6addr"
+		}
+		submitted, _ := r.Context().Value(key).(*netip.Addr)
+		if submitted == nil || *submitted != addr {
+			http.Error(w, param+" does not match client address", http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func IPValidationMiddleware(next http.Handler) http.Handler {
 	parseAddrOrEmpty := func(ipStr string) (*netip.Addr, error) {
 		if ipStr == "" {
@@ -131,8 +231,26 @@ func IPValidationMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func ZonefileWriteHandler(filename string, domainSubpart string, z zoneFileWriter) func(w http.ResponseWriter, r *http.Request) {
+// updateResult is the response body of the updater with format=json.
+type updateResult struct {
+	Host     string      `json:"host"`
+	Changed  bool        `json:"changed"`
+	IPv4     *netip.Addr `json:"ipv4"`
+	IPv6     *netip.Addr `json:"ipv6"`
+	Previous struct {
+		IPv4 *netip.Addr `json:"ipv4"`
+		IPv6 *netip.Addr `json:"ipv6"`
+	} `json:"previous"`
+	Error string `json:"error,omitempty"`
+}
+
+// ZonefileWriteHandler publishes the addresses from IPValidationMiddleware.
+// By default it answers with a plain "Ok", which is all the Fritz!Box looks
+// at; format=json returns an updateResult instead. Either way a failed
+// update is reported with a 500.
+func ZonefileWriteHandler(domainSubpart string, s *zoneStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		asJSON := r.URL.Query().Get("format") == "json"
 		ipaddr, _ := r.Context().Value(ctxIPv4Key).(*netip.Addr)
 		ipv6addr, _ := r.Context().Value(ctxIPv6Key).(*netip.Addr)
 
@@ -140,37 +258,81 @@ func ZonefileWriteHandler(filename string, domainSubpart string, z zoneFileWrite
 		// truncate the zonefile with no records, which silently removes the
 		// DNS name. Acknowledge with Ok and leave the zone untouched.
 		if ipaddr == nil && ipv6addr == nil {
+			updatesTotal.Inc(updateResultEmpty)
+			if asJSON {
+				h, _ := s.Host(domainSubpart)
+				result := updateResult{Host: domainSubpart, IPv4: h.IPv4, IPv6: h.IPv6}
+				result.Previous.IPv4, result.Previous.IPv6 = h.IPv4, h.IPv6
+				writeJSON(w, http.StatusOK, result)
+				return
+			}
 			fmt.Fprintln(w, "Ok")
 			return
 		}
 
-		z.Set(subdomain{
-			Subpart: domainSubpart,
-			TTL:     60,
-			IPv4:    ipaddr,
-			IPv6:    ipv6addr,
-		})
+		// Keep the TTL set via the API or read back from the zonefile.
+		h, _ := s.Host(domainSubpart)
+		h.Name = domainSubpart
+		h.IPv4, h.IPv6 = ipaddr, ipv6addr
+		h.Client = remoteHost(r)
+		prev, err := s.Apply(h)
+
+		result := updateResult{Host: domainSubpart, IPv4: ipaddr, IPv6: ipv6addr}
+		result.Previous.IPv4, result.Previous.IPv6 = prev.IPv4, prev.IPv6
 
-		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
-			slog.Error("cannot open zonefile", "filename", filename, "err", err)
-			fmt.Fprintln(w, "Ok")
+			updatesTotal.Inc(updateResultError)
+			slog.Error("cannot update zonefile", "err", err)
+			if asJSON {
+				result.Error = "cannot update zonefile"
+				writeJSON(w, http.StatusInternalServerError, result)
+				return
+			}
+			http.Error(w, "cannot update zonefile", http.StatusInternalServerError)
 			return
 		}
-		defer f.Close()
 
-		if err := z.Write(f); err != nil {
-			slog.Error("cannot write zonefile", "filename", filename, "err", err)
+		result.Changed = h.addressChanged(prev)
+		if result.Changed {
+			updatesTotal.Inc(updateResultChanged)
+		} else {
+			updatesTotal.Inc(updateResultUnchanged)
+		}
+
+		if asJSON {
+			writeJSON(w, http.StatusOK, result)
+			return
 		}
 		fmt.Fprintln(w, "Ok")
 	}
 }
 
-func updaterHandler(c updaterHandlerConfig) http.Handler {
+// addressHandler publishes the submitted addresses of authenticated
+// requests.
+func addressHandler(c updaterHandlerConfig, s *zoneStore) http.Handler {
+	addresses := chi.Chain(IPValidationMiddleware)
+	if c.RequireSourceMatch {
+		addresses = append(addresses, SourceMatchMiddleware)
+	}
+	return addresses.HandlerFunc(ZonefileWriteHandler(c.DomainSubpart, s))
+}
+
+// updaterHandler serves the updater. nonces are shared with the updater of
+// the previous configuration, so a reload does not allow replays.
+func updaterHandler(c updaterHandlerConfig, s *zoneStore, nonces *nonceCache, access accessRules) http.Handler {
+	write := addressHandler(c, s)
+
+	withPassword := chi.Chain(UserValidationMiddleware(c.User, access.validate), PasswordValidationMiddleware(access.validate)).Handler(write)
+	signed := chi.Chain(SignatureValidationMiddleware(c.DomainSubpart, c.Signing.Secret, c.Signing.MaxSkew, nonces)).Handler(write)
+
 	route := chi.NewRouter()
-	route.Use(UserValidationMiddleware(c.User))
-	route.Use(PasswordValidationMiddleware(argonPasswordValidator(c.Password.Key, c.Password.Salt, c.Password.Time, c.Password.Memory, c.Password.Threads, c.Password.KeyLen)))
-	route.Use(IPValidationMiddleware)
-	route.Get("/", ZonefileWriteHandler(c.Filename, c.DomainSubpart, newZonefile()))
+	route.Use(ClientAllowlistMiddleware(access.allowed))
+	route.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("sig") {
+			signed.ServeHTTP(w, r)
+			return
+		}
+		withPassword.ServeHTTP(w, r)
+	})
 	return route
 }
@@ -97,7 +97,7 @@ func TestUserValidationMiddleware(t *testing.T) {
 		{httptest.NewRequest("GET", "/?user=baz", nil), 200},
 	} {
 		route := chi.NewRouter()
-		route.Use(UserValidationMiddleware("baz"))
+		route.Use(UserValidationMiddleware("baz", func(origPasswd []byte) bool { return false }))
 		route.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, "Ok")
 		})
@@ -111,6 +111,129 @@ func TestUserValidationMiddleware(t *testing.T) {
 	}
 }
 
+func TestClientAllowlistMiddleware(t *testing.T) {
+	allowed := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")}
+
+	for _, testCase := range []struct {
+		name               string
+		allowed            []netip.Prefix
+		remoteAddr         string
+		expectedStatusCode int
+	}{
+		{"no restrictions", nil, "198.51.100.1:1234", 200},
+		{"allowed ipv4", allowed, "192.0.2.1:1234", 200},
+		{"allowed ipv6", allowed, "[2001:db8::1]:1234", 200},
+		{"mapped ipv4", allowed, "[::ffff:192.0.2.1]:1234", 200},
+		{"outside allowlist", allowed, "198.51.100.1:1234", 403},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			route := chi.NewRouter()
+			route.Use(ClientAllowlistMiddleware(testCase.allowed))
+			route.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, "Ok")
+			})
+
+			req := httptest.NewRequest("GET", "/?user=baz", nil)
+			req.RemoteAddr = testCase.remoteAddr
+			w := httptest.NewRecorder()
+			route.ServeHTTP(w, req)
+			if w.Code != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v", w.Code, testCase.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestSourceMatchMiddleware(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		remoteAddr         string
+		query              string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"matching ipaddr", "198.51.100.1:1234", "/?ipaddr=198.51.100.1&ip6addr=2001:db8::2", 200, "Ok"},
+		{"matching ip6addr", "[2001:db8::1]:1234", "/?ipaddr=192.0.2.2&ip6addr=2001:db8::1", 200, "Ok"},
+		{"mapped ipv4", "[::ffff:198.51.100.1]:1234", "/?ipaddr=198.51.100.1", 200, "Ok"},
+		{"other ipaddr", "198.51.100.1:1234", "/?ipaddr=198.51.100.2", 400, "ipaddr does not match client address"},
+		{"other ip6addr", "[2001:db8::1]:1234", "/?ip6addr=2001:db8::2", 400, "ip6addr does not match client address"},
+		{"missing ipaddr", "198.51.100.1:1234", "/?ip6addr=2001:db8::1", 400, "ipaddr does not match client address"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			route := chi.NewRouter()
+			route.Use(IPValidationMiddleware)
+			route.Use(SourceMatchMiddleware)
+			route.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, "Ok")
+			})
+
+			req := httptest.NewRequest("GET", testCase.query, nil)
+			req.RemoteAddr = testCase.remoteAddr
+			w := httptest.NewRecorder()
+			route.ServeHTTP(w, req)
+			if w.Code != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v", w.Code, testCase.expectedStatusCode)
+			}
+			if body := strings.TrimSpace(w.Body.String()); body != testCase.expectedBody {
+				t.Errorf("body is %q instead of %q", body, testCase.expectedBody)
+			}
+		})
+	}
+}
+
+// TestUserValidationMiddleware_TimingUniform verifies that unknown users pay
+// for the same argon2id derivation as the configured user, so response time
+// does not reveal whether a username exists.
+func TestUserValidationMiddleware_TimingUniform(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectValidate     bool
+	}{
+		{"known user", "/?user=baz&passwd=LnRlc3Qu", 401, true},
+		{"unknown user", "/?user=foobar&passwd=LnRlc3Qu", 401, true},
+		{"empty user", "/?user=&passwd=LnRlc3Qu", 401, true},
+		// PasswordValidationMiddleware skips the derivation for missing or
+		// undecodable passwords, so unknown users must skip it as well.
+		{"known user without password", "/?user=baz", 401, false},
+		{"unknown user without password", "/?user=foobar", 401, false},
+		{"unknown user with invalid password", "/?user=foobar&passwd=a+b/", 401, false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			calls := 0
+			validate := func(origPasswd []byte) bool {
+				calls++
+				if !bytes.Equal(origPasswd, []byte(".test.")) {
+					t.Errorf("password missmatch: %s != \".test.\"", origPasswd)
+				}
+				return false
+			}
+
+			route := chi.NewRouter()
+			route.Use(UserValidationMiddleware("baz", validate))
+			route.Use(PasswordValidationMiddleware(validate))
+			route.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("handler should not be reached")
+			})
+
+			w := httptest.NewRecorder()
+			route.ServeHTTP(w, httptest.NewRequest("GET", testCase.query, nil))
+			if w.Result().StatusCode != testCase.expectedStatusCode {
+				t.Errorf("status code is %v instead of %v", w.Result().StatusCode, testCase.expectedStatusCode)
+			}
+
+			wantCalls := 0
+			if testCase.expectValidate {
+				wantCalls = 1
+			}
+			if calls != wantCalls {
+				t.Errorf("validator ran %d times instead of %d", calls, wantCalls)
+			}
+		})
+	}
+}
+
 func TestIPValidationMiddleware(t *testing.T) {
 	checkContext := func(t *testing.T, r *http.Request, ctxKey ctxIPKey, expectedValue *netip.Addr) {
 		t.Helper()
@@ -196,11 +319,12 @@ func TestZonefileWriteHandler(t *testing.T) {
 	ipv4 := netip.MustParseAddr("192.168.1.1")
 	ipv6 := netip.MustParseAddr("2001:db8::1")
 
-	stale := []byte("STALE-CONTENT-THAT-MUST-NOT-SURVIVE\n")
+	stale := []byte("example.{DOM_HOSTNAME}. 60 IN A 10.0.0.99\n")
 	tmpMissing := filepath.Join(t.TempDir(), "does", "not", "exist", "zone.txt")
 
 	for _, testCase := range []struct {
 		name                string
+		query               string
 		filePath            func(t *testing.T) string
 		ctx                 context.Context
 		writeError          error
@@ -247,19 +371,47 @@ func TestZonefileWriteHandler(t *testing.T) {
 			wantWriterUntouched: true,
 		},
 		{
-			// Errors are logged internally; the client always sees Ok.
 			name:         "write error",
 			filePath:     func(t *testing.T) string { return freshTempWithStale(t, stale) },
+			ctx:          context.WithValue(ctx, ctxIPv4Key, &ipv4),
 			writeError:   fmt.Errorf("disk on fire"),
-			wantStatus:   http.StatusOK,
-			wantBody:     "Ok",
+			wantStatus:   http.StatusInternalServerError,
+			wantBody:     "cannot update zonefile",
 			wantTruncate: false,
 		},
 		{
 			name:       "open error",
 			filePath:   func(t *testing.T) string { return tmpMissing },
-			wantStatus: http.StatusOK,
-			wantBody:   "Ok",
+			ctx:        context.WithValue(ctx, ctxIPv4Key, &ipv4),
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "cannot update zonefile",
+		},
+		{
+			name:         "json",
+			query:        "?format=json",
+			filePath:     func(t *testing.T) string { return freshTempWithStale(t, stale) },
+			ctx:          context.WithValue(ctx, ctxIPv4Key, &ipv4),
+			wantStatus:   http.StatusOK,
+			wantBody:     `{"host":"example","changed":true,"ipv4":"192.168.1.1","ipv6":null,"previous":{"ipv4":null,"ipv6":null}}`,
+			wantTruncate: true,
+		},
+		{
+			name:                "json v4 and v6 both nil",
+			query:               "?format=json",
+			filePath:            func(t *testing.T) string { return freshTempWithStale(t, stale) },
+			ctx:                 context.Background(),
+			wantStatus:          http.StatusOK,
+			wantBody:            `{"host":"example","changed":false,"ipv4":null,"ipv6":null,"previous":{"ipv4":null,"ipv6":null}}`,
+			wantStaleSurvives:   true,
+			wantWriterUntouched: true,
+		},
+		{
+			name:       "json open error",
+			query:      "?format=json",
+			filePath:   func(t *testing.T) string { return tmpMissing },
+			ctx:        context.WithValue(ctx, ctxIPv6Key, &ipv6),
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"host":"example","changed":false,"ipv4":null,"ipv6":"2001:db8::1","previous":{"ipv4":null,"ipv6":null},"error":"cannot update zonefile"}`,
 		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -276,10 +428,10 @@ func TestZonefileWriteHandler(t *testing.T) {
 			}
 
 			route := chi.NewRouter()
-			route.Get("/", ZonefileWriteHandler(path, "example", writer))
+			route.Get("/", ZonefileWriteHandler("example", newZoneStore(newFileBackend(path, writer), "example")))
 
 			w := httptest.NewRecorder()
-			route.ServeHTTP(w, httptest.NewRequest("GET", "/", nil).WithContext(routeCtx))
+			route.ServeHTTP(w, httptest.NewRequest("GET", "/"+testCase.query, nil).WithContext(routeCtx))
 			resp := w.Result()
 			if resp.StatusCode != testCase.wantStatus {
 				t.Errorf("status code is %v instead of %v", resp.StatusCode, testCase.wantStatus)
@@ -321,8 +473,29 @@ func TestZonefileWriteHandler(t *testing.T) {
 	}
 }
 
+func TestZonefileWriteHandler_KeepsTTL(t *testing.T) {
+	s := newZoneStore(newFileBackend(filepath.Join(t.TempDir(), "zone.txt"), newZonefile()), "home")
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	if _, err := s.Apply(hostState{Name: "home", TTL: 300, IPv4: &ipv4}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := netip.MustParseAddr("192.168.1.2")
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxIPv4Key, &updated))
+	w := httptest.NewRecorder()
+	ZonefileWriteHandler("home", s)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code is %v instead of %v", w.Code, http.StatusOK)
+	}
+
+	if h, _ := s.Host("home"); h.TTL != 300 || h.IPv4 == nil || *h.IPv4 != updated {
+		t.Errorf("update did not keep the ttl: %+v", h)
+	}
+}
+
 // freshTempWithStale returns a path to a temp file pre-filled with stale,
-// so O_TRUNC is observable.
+// so replacing it is observable.
 func freshTempWithStale(t *testing.T, stale []byte) string {
 	t.Helper()
 	file, err := os.CreateTemp("", "zone-*")
@@ -342,7 +515,7 @@ func freshTempWithStale(t *testing.T, stale []byte) string {
 
 func TestHttpRouter(t *testing.T) {
 	route := chi.NewRouter()
-	route.Mount("/", updaterHandler(updaterHandlerConfig{}))
+	route.Mount("/", updaterHandler(updaterHandlerConfig{}, newZoneStore(newFileBackend("", newZonefile())), newNonceCache(0), testAccessRules(updaterHandlerConfig{})))
 
 	// Without valid credentials the user-validation middleware returns 401,
 	// proving the router is fully wired.
@@ -391,31 +564,32 @@ func TestEndToEnd_FritzBoxUpdate(t *testing.T) {
 			name:           "v6 only",
 			query:          "/?user=dyndns&passwd=" + passwd + "&ip6addr=" + ipv6,
 			wantInZonefile: []string{aaaaRecord},
-			wantNotInZone:  []string{"IN A "},
+			wantNotInZone:  []string{"dyndns.{DOM_HOSTNAME}. 60 IN A "},
 			wantStaleTrunc: true,
 		},
 		{
 			name:           "v4 only",
 			query:          "/?user=dyndns&passwd=" + passwd + "&ipaddr=" + ipv4,
 			wantInZonefile: []string{aRecord},
-			wantNotInZone:  []string{"IN AAAA "},
+			wantNotInZone:  []string{"dyndns.{DOM_HOSTNAME}. 60 IN AAAA "},
 			wantStaleTrunc: true,
 		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
-			zonePath := freshTempWithStale(t, []byte("STALE\n"))
+			zonePath := freshTempWithStale(t, []byte("{DEFAULT_ZONEFILE}\ndyndns.{DOM_HOSTNAME}. 60 IN A 10.0.0.99\nwww.{DOM_HOSTNAME}. 3600 IN A 192.0.2.80\n"))
 
 			// Same middlewares updaterHandler uses, but with a trivial
 			// constant-time password check so the test does not depend
 			// on argon parameters. newZonefile() is the real production
 			// writer.
 			route := chi.NewRouter()
-			route.Use(UserValidationMiddleware("dyndns"))
-			route.Use(PasswordValidationMiddleware(func(origPasswd []byte) bool {
+			validate := func(origPasswd []byte) bool {
 				return subtle.ConstantTimeCompare(origPasswd, []byte("secret-password")) == 1
-			}))
+			}
+			route.Use(UserValidationMiddleware("dyndns", validate))
+			route.Use(PasswordValidationMiddleware(validate))
 			route.Use(IPValidationMiddleware)
-			route.Get("/", ZonefileWriteHandler(zonePath, "dyndns", newZonefile()))
+			route.Get("/", ZonefileWriteHandler("dyndns", newZoneStore(newFileBackend(zonePath, newZonefile()), "dyndns")))
 
 			w := httptest.NewRecorder()
 			route.ServeHTTP(w, httptest.NewRequest("GET", testCase.query, nil))
@@ -439,9 +613,15 @@ func TestEndToEnd_FritzBoxUpdate(t *testing.T) {
 					t.Errorf("zonefile unexpectedly contains %q; got: %q", unwanted, got)
 				}
 			}
-			if testCase.wantStaleTrunc && bytes.Contains(got, []byte("STALE")) {
+			if testCase.wantStaleTrunc && bytes.Contains(got, []byte("10.0.0.99")) {
 				t.Errorf("stale content was not truncated: %q", got)
 			}
+			if !bytes.Contains(got, []byte("www.{DOM_HOSTNAME}. 3600 IN A 192.0.2.80")) {
+				t.Errorf("unmanaged record was lost: %q", got)
+			}
+			if n := bytes.Count(got, []byte("{DEFAULT_ZONEFILE}")); n != 1 {
+				t.Errorf("zonefile contains {DEFAULT_ZONEFILE} %d times instead of once: %q", n, got)
+			}
 		})
 	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+type mailConfig struct {
+	Addr string
+	From string
+	To   []string
+}
+
+type notifyConfig struct {
+	Webhook string
+	Command []string
+	Mail    mailConfig
+}
+
+type watchdogConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Notify   notifyConfig
+}
+
+// staleEvent is sent once a host misses its maxAge and once more when it
+// checks in again.
+type staleEvent struct {
+	Host       string        `json:"host"`
+	Stale      bool          `json:"stale"`
+	LastUpdate time.Time     `json:"lastUpdate,omitzero"`
+	MaxAge     time.Duration `json:"maxAge"`
+}
+
+func (e staleEvent) state() string {
+	if e.Stale {
+		return "stale"
+	}
+	return "recovered"
+}
+
+func (e staleEvent) String() string {
+	if e.Stale {
+		return fmt.Sprintf("%s has not been updated within %s (last update: %s)", e.Host, e.MaxAge, formatLastUpdate(e.LastUpdate))
+	}
+	return fmt.Sprintf("%s has been updated again at %s", e.Host, formatLastUpdate(e.LastUpdate))
+}
+
+func formatLastUpdate(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+type notifier interface {
+	Notify(ctx context.Context, e staleEvent) error
+}
+
+type notifiers []notifier
+
+func (ns notifiers) Notify(ctx context.Context, e staleEvent) error {
+	errs := []error{}
+	for _, n := range ns {
+		if err := n.Notify(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, e staleEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+type commandNotifier struct {
+	command []string
+}
+
+func (n *commandNotifier) Notify(ctx context.Context, e staleEvent) error {
+	return runCommand(ctx, n.command, []string{
+		"DYNDNS_HOST=" + e.Host,
+		"DYNDNS_STATE=" + e.state(),
+		"DYNDNS_LAST_UPDATE=" + formatLastUpdate(e.LastUpdate),
+		"DYNDNS_MAX_AGE=" + e.MaxAge.String(),
+	})
+}
+
+// runCommand runs command with env added to the environment of the server.
+// ctx bounds its runtime.
+func runCommand(ctx context.Context, command []string, env []string) error {
+	_, err := runCommandStatus(ctx, command, env)
+	return err
+}
+
+// runCommandStatus runs command like runCommand and also returns its exit
+// status, which is -1 if it did not exit on its own, e.g. when it was killed.
+func runCommandStatus(ctx context.Context, command []string, env []string) (int, error) {
+	if len(command) == 0 {
+		return -1, fmt.Errorf("empty command")
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		exitStatus := -1
+		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+			exitStatus = exitErr.ExitCode()
+		}
+		return exitStatus, fmt.Errorf("command %s failed: %w: %s", command[0], err, bytes.TrimSpace(out))
+	}
+	return cmd.ProcessState.ExitCode(), nil
+}
+
+type mailNotifier struct {
+	mailConfig
+}
+
+func (n *mailNotifier) Notify(ctx context.Context, e staleEvent) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: hostsharing-dyndns: %s is %s\r\n\r\n%s\r\n",
+		n.From, strings.Join(n.To, ", "), e.Host, e.state(), e)
+
+	if err := smtp.SendMail(n.Addr, nil, n.From, n.To, []byte(msg)); err != nil {
+		return fmt.Errorf("cannot send mail: %w", err)
+	}
+	return nil
+}
+
+func newNotifier(c notifyConfig) notifiers {
+	ns := notifiers{}
+	if c.Webhook != "" {
+		ns = append(ns, &webhookNotifier{url: c.Webhook, client: http.DefaultClient})
+	}
+	if len(c.Command) > 0 {
+		ns = append(ns, &commandNotifier{command: c.Command})
+	}
+	if c.Mail.Addr != "" {
+		ns = append(ns, &mailNotifier{c.Mail})
+	}
+	return ns
+}
+
+// watchdog notifies when a host has not checked in within its maxAge.
+// Hosts that were not updated since start count from the start of the
+// watchdog, as the store does not survive restarts.
+type watchdog struct {
+	store    *zoneStore
+	maxAge   map[string]time.Duration
+	notifier notifier
+	timeout  time.Duration
+	state    *watchdogState
+	now      func() time.Time
+}
+
+// watchdogState is what a watchdog remembers between checks. It is kept
+// across configuration reloads, so hosts are not reported twice.
+type watchdogState struct {
+	mu      sync.Mutex
+	started time.Time
+	stale   map[string]bool
+}
+
+func newWatchdogState() *watchdogState {
+	return &watchdogState{started: time.Now(), stale: map[string]bool{}}
+}
+
+func newWatchdog(s *zoneStore, maxAge map[string]time.Duration, n notifier, timeout time.Duration, state *watchdogState) *watchdog {
+	return &watchdog{
+		store:    s,
+		maxAge:   maxAge,
+		notifier: n,
+		timeout:  timeout,
+		state:    state,
+		now:      time.Now,
+	}
+}
+
+// Check compares every host against its maxAge and notifies about hosts
+// that became stale or recovered since the last check.
+func (wd *watchdog) Check(ctx context.Context) {
+	// The watchdogs of two configurations may overlap during a reload.
+	wd.state.mu.Lock()
+	defer wd.state.mu.Unlock()
+
+	for _, h := range wd.store.Hosts() {
+		maxAge, ok := wd.maxAge[h.Name]
+		if !ok || maxAge <= 0 {
+			continue
+		}
+
+		since := h.UpdatedAt
+		if since.IsZero() {
+			since = wd.state.started
+		}
+		stale := wd.now().Sub(since) > maxAge
+		if stale == wd.state.stale[h.Name] {
+			continue
+		}
+
+		e := staleEvent{Host: h.Name, Stale: stale, LastUpdate: h.UpdatedAt, MaxAge: maxAge}
+		notifyCtx, cancel := context.WithTimeout(ctx, wd.timeout)
+		err := wd.notifier.Notify(notifyCtx, e)
+		cancel()
+		if err != nil {
+			// Keep the previous state, so the next check tries again.
+			slog.Error("cannot send watchdog notification", "host", h.Name, "state", e.state(), "err", err)
+			continue
+		}
+		slog.Info("sent watchdog notification", "host", h.Name, "state", e.state())
+		wd.state.stale[h.Name] = stale
+	}
+}
+
+// Run checks every interval until ctx is done.
+func (wd *watchdog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wd.Check(ctx)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	events []staleEvent
+	err    error
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, e staleEvent) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.events = append(n.events, e)
+	return nil
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	s := newZoneStore(newFileBackend(filepath.Join(t.TempDir(), "zone.txt"), newZonefile()), "home", "office")
+
+	n := &recordingNotifier{}
+	wd := newWatchdog(s, map[string]time.Duration{"home": time.Hour}, n, time.Second, newWatchdogState())
+	now := wd.state.started
+	wd.now = func() time.Time { return now }
+
+	expectEvents := func(t *testing.T, expected ...bool) {
+		t.Helper()
+		if len(n.events) != len(expected) {
+			t.Fatalf("got %d notifications instead of %d: %+v", len(n.events), len(expected), n.events)
+		}
+		for i, stale := range expected {
+			if n.events[i].Host != "home" || n.events[i].Stale != stale || n.events[i].MaxAge != time.Hour {
+				t.Errorf("notification %d is %+v, expected stale=%v for home", i, n.events[i], stale)
+			}
+		}
+	}
+
+	wd.Check(context.Background())
+	expectEvents(t)
+
+	// Without any update since start, maxAge counts from the start.
+	now = now.Add(61 * time.Minute)
+	wd.Check(context.Background())
+	expectEvents(t, true)
+	if !n.events[0].LastUpdate.IsZero() {
+		t.Errorf("last update should be unset, got %v", n.events[0].LastUpdate)
+	}
+
+	// Only once per transition.
+	wd.Check(context.Background())
+	expectEvents(t, true)
+
+	if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+		t.Fatal(err)
+	}
+	now = time.Now()
+	wd.Check(context.Background())
+	expectEvents(t, true, false)
+
+	// A failed notification is retried on the next check.
+	now = now.Add(2 * time.Hour)
+	n.err = fmt.Errorf("webhook down")
+	wd.Check(context.Background())
+	expectEvents(t, true, false)
+	n.err = nil
+	wd.Check(context.Background())
+	expectEvents(t, true, false, true)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got staleEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	n := &webhookNotifier{url: server.URL, client: server.Client()}
+	e := staleEvent{Host: "home", Stale: true, MaxAge: time.Hour}
+	if err := n.Notify(context.Background(), e); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != e {
+		t.Errorf("webhook received %+v instead of %+v", got, e)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	n = &webhookNotifier{url: failing.URL, client: failing.Client()}
+	if err := n.Notify(context.Background(), e); err == nil {
+		t.Errorf("expected error for non-2xx response")
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	n := &commandNotifier{command: []string{"sh", "-c", `echo "$DYNDNS_HOST $DYNDNS_STATE $DYNDNS_MAX_AGE" > "$0"`, out}}
+
+	if err := n.Notify(context.Background(), staleEvent{Host: "home", Stale: false, MaxAge: time.Hour}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(got)) != "home recovered 1h0m0s" {
+		t.Errorf("command saw %q", got)
+	}
+
+	n = &commandNotifier{command: []string{"sh", "-c", "echo broken >&2; exit 3"}}
+	if err := n.Notify(context.Background(), staleEvent{Host: "home"}); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected error with command output, got %v", err)
+	}
+}
+
+// fakeSMTPServer accepts a single mail and sends its DATA to the returned
+// channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	data := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "DATA"):
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				var b strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					b.WriteString(line)
+				}
+				data <- b.String()
+				fmt.Fprint(conn, "250 ok\r\n")
+			case strings.HasPrefix(cmd, "QUIT"):
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+	return ln.Addr().String(), data
+}
+
+func TestMailNotifier(t *testing.T) {
+	addr, data := fakeSMTPServer(t)
+	n := &mailNotifier{mailConfig{Addr: addr, From: "dyndns@example.com", To: []string{"admin@example.com"}}}
+
+	if err := n.Notify(context.Background(), staleEvent{Host: "home", Stale: true, MaxAge: time.Hour}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg := <-data
+	for _, want := range []string{"To: admin@example.com", "Subject: hostsharing-dyndns: home is stale", "home has not been updated within 1h0m0s (last update: never)"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("mail is missing %q: %q", want, msg)
+		}
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	if n := newNotifier(notifyConfig{}); len(n) != 0 {
+		t.Errorf("expected no notifier, got %d", len(n))
+	}
+	n := newNotifier(notifyConfig{
+		Webhook: "http://localhost/",
+		Command: []string{"true"},
+		Mail:    mailConfig{Addr: "localhost:25", From: "a@example.com", To: []string{"b@example.com"}},
+	})
+	if len(n) != 3 {
+		t.Errorf("expected 3 notifiers, got %d", len(n))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type webhookConfig struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	// Body is a text/template rendered with an addressChange. Without it the
+	// addressChange is sent as JSON.
+	Body string
+	// Secret signs the body with HMAC-SHA256. The signature is sent as
+	// "X-Signature-256: sha256=<hex>".
+	Secret  string
+	Retries int
+	Backoff time.Duration
+}
+
+// addressChange is passed to webhook body templates. Missing addresses are
+// empty strings.
+type addressChange struct {
+	Host         string    `json:"host"`
+	TTL          uint      `json:"ttl"`
+	IPv4         string    `json:"ipv4"`
+	IPv6         string    `json:"ipv6"`
+	PreviousIPv4 string    `json:"previousIPv4"`
+	PreviousIPv6 string    `json:"previousIPv6"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func addrString(a *netip.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func newAddressChange(prev, h hostState) addressChange {
+	return addressChange{
+		Host:         h.Name,
+		TTL:          h.TTL,
+		IPv4:         addrString(h.IPv4),
+		IPv6:         addrString(h.IPv6),
+		PreviousIPv4: addrString(prev.IPv4),
+		PreviousIPv6: addrString(prev.IPv6),
+		UpdatedAt:    h.UpdatedAt,
+	}
+}
+
+type webhook struct {
+	webhookConfig
+	body *template.Template
+}
+
+func newWebhook(c webhookConfig) (*webhook, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("undefined webhook url")
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = time.Second
+	}
+
+	wh := &webhook{webhookConfig: c}
+	if c.Body != "" {
+		tmpl, err := template.New("Webhook").Option("missingkey=error").Parse(c.Body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse webhook body for %s: %w", c.URL, err)
+		}
+		wh.body = tmpl
+	}
+	return wh, nil
+}
+
+func (wh *webhook) render(e addressChange) ([]byte, error) {
+	if wh.body == nil {
+		return json.Marshal(e)
+	}
+	var b bytes.Buffer
+	if err := wh.body.Execute(&b, e); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (wh *webhook) send(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, wh.Method, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range wh.Headers {
+		req.Header.Set(k, v)
+	}
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookDispatcher sends the configured webhooks for every address change.
+// Its Notify method is a changeListener and returns immediately; delivery,
+// including retries with exponential backoff, runs in the background.
+type webhookDispatcher struct {
+	hooks  []*webhook
+	client *http.Client
+	wg     sync.WaitGroup
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+func newWebhookDispatcher(cs []webhookConfig) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		client: &http.Client{Timeout: 10 * time.Second},
+		sleep:  sleepContext,
+	}
+	for _, c := range cs {
+		wh, err := newWebhook(c)
+		if err != nil {
+			return nil, err
+		}
+		d.hooks = append(d.hooks, wh)
+	}
+	return d, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (d *webhookDispatcher) Notify(prev, h hostState) {
+	e := newAddressChange(prev, h)
+	for _, wh := range d.hooks {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.deliver(context.Background(), wh, e)
+		}()
+	}
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, wh *webhook, e addressChange) {
+	body, err := wh.render(e)
+	if err != nil {
+		slog.Error("cannot render webhook body", "url", wh.URL, "err", err)
+		return
+	}
+
+	backoff := wh.Backoff
+	for attempt := 0; ; attempt++ {
+		err := wh.send(ctx, d.client, body)
+		if err == nil {
+			slog.Info("sent webhook", "url", wh.URL, "host", e.Host)
+			return
+		}
+		if attempt >= wh.Retries {
+			slog.Error("cannot send webhook", "url", wh.URL, "host", e.Host, "attempts", attempt+1, "err", err)
+			return
+		}
+		slog.Warn("cannot send webhook, retrying", "url", wh.URL, "host", e.Host, "backoff", backoff, "err", err)
+		if err := d.sleep(ctx, backoff); err != nil {
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// Wait blocks until all pending deliveries finished.
+func (d *webhookDispatcher) Wait() {
+	d.wg.Wait()
+}
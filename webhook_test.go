@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	method    string
+	header    http.Header
+	body      []byte
+	signature string
+}
+
+// webhookServer records every request and answers with the next status
+// from statuses, or 200 once they are used up.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := []webhookRequest{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, webhookRequest{r.Method, r.Header, body, r.Header.Get("X-Signature-256")})
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest{}, requests...)
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	server, requests := webhookServer(t)
+
+	d, err := newWebhookDispatcher([]webhookConfig{{
+		URL:     server.URL,
+		Method:  http.MethodPut,
+		Headers: map[string]string{"X-Api-Key": "abc"},
+		Body:    `{"name": "{{ .Host }}", "v4": "{{ .IPv4 }}", "old": "{{ .PreviousIPv4 }}"}`,
+		Secret:  "s3cret",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newZoneStore(newFileBackend(filepath.Join(t.TempDir(), "zone.txt"), newZonefile()), "home")
+	s.OnChange(d.Notify)
+
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+	for range 2 {
+		if _, err := s.Apply(hostState{Name: "home", TTL: 60, IPv4: &ipv4}); err != nil {
+			t.Fatal(err)
+		}
+		d.Wait()
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("webhook was called %d times instead of once; unchanged updates must not fire", len(got))
+	}
+	if got[0].method != http.MethodPut {
+		t.Errorf("method is %s instead of PUT", got[0].method)
+	}
+	if got[0].header.Get("X-Api-Key") != "abc" {
+		t.Errorf("configured header is missing: %v", got[0].header)
+	}
+	if string(got[0].body) != `{"name": "home", "v4": "192.168.1.1", "old": ""}` {
+		t.Errorf("unexpected body %s", got[0].body)
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(got[0].body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got[0].signature != want {
+		t.Errorf("signature is %q instead of %q", got[0].signature, want)
+	}
+}
+
+func TestWebhookDispatcher_DefaultBody(t *testing.T) {
+	server, requests := webhookServer(t)
+	d, err := newWebhookDispatcher([]webhookConfig{{URL: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipv4 := netip.MustParseAddr("192.168.1.2")
+	prevIPv4 := netip.MustParseAddr("192.168.1.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	d.Notify(hostState{Name: "home", IPv4: &prevIPv4}, hostState{Name: "home", TTL: 60, IPv4: &ipv4, IPv6: &ipv6})
+	d.Wait()
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("webhook was called %d times instead of once", len(got))
+	}
+	if got[0].method != http.MethodPost || got[0].signature != "" {
+		t.Errorf("expected unsigned POST, got %s with signature %q", got[0].method, got[0].signature)
+	}
+	var e addressChange
+	if err := json.Unmarshal(got[0].body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Host != "home" || e.IPv4 != "192.168.1.2" || e.IPv6 != "2001:db8::1" || e.PreviousIPv4 != "192.168.1.1" || e.PreviousIPv6 != "" {
+		t.Errorf("unexpected body %+v", e)
+	}
+}
+
+func TestWebhookDispatcher_Retries(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		statuses         []int
+		retries          int
+		expectedAttempts int
+		expectedBackoffs []time.Duration
+	}{
+		{"succeeds after retries", []int{500, 502}, 3, 3, []time.Duration{time.Second, 2 * time.Second}},
+		{"gives up", []int{500, 500, 500}, 2, 3, []time.Duration{time.Second, 2 * time.Second}},
+		{"no retries", []int{500}, 0, 1, nil},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, requests := webhookServer(t, testCase.statuses...)
+			d, err := newWebhookDispatcher([]webhookConfig{{URL: server.URL, Retries: testCase.retries}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var backoffs []time.Duration
+			d.sleep = func(ctx context.Context, d time.Duration) error {
+				backoffs = append(backoffs, d)
+				return nil
+			}
+
+			ipv4 := netip.MustParseAddr("192.168.1.1")
+			d.Notify(hostState{Name: "home"}, hostState{Name: "home", IPv4: &ipv4})
+			d.Wait()
+
+			if got := len(requests()); got != testCase.expectedAttempts {
+				t.Errorf("webhook was called %d times instead of %d", got, testCase.expectedAttempts)
+			}
+			if len(backoffs) != len(testCase.expectedBackoffs) {
+				t.Fatalf("backoffs are %v instead of %v", backoffs, testCase.expectedBackoffs)
+			}
+			for i := range backoffs {
+				if backoffs[i] != testCase.expectedBackoffs[i] {
+					t.Errorf("backoffs are %v instead of %v", backoffs, testCase.expectedBackoffs)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWebhookDispatcher_InvalidConfig(t *testing.T) {
+	for _, testCase := range []struct {
+		name string
+		c    webhookConfig
+	}{
+		{"missing url", webhookConfig{}},
+		{"broken template", webhookConfig{URL: "http://localhost/", Body: "{{ .Host "}},
+	} {
+		if _, err := newWebhookDispatcher([]webhookConfig{testCase.c}); err == nil {
+			t.Errorf("%s: expected error", testCase.name)
+		}
+	}
+}
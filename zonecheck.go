@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ZONEFILE_PLACEHOLDERS are the Hostsharing placeholders a rendered zonefile
+// may contain. Hostsharing replaces them before loading the zone.
+var ZONEFILE_PLACEHOLDERS = map[string]bool{
+	"DEFAULT_ZONEFILE": true,
+	"DOM_HOSTNAME":     true,
+}
+
+// placeholderDomain stands in for {DOM_HOSTNAME} while parsing.
+const placeholderDomain = "dom-hostname.invalid"
+
+// validateZonefile parses a zonefile the way Hostsharing would after
+// replacing its placeholders. It rejects unknown or broken placeholders, more
+// than one {DEFAULT_ZONEFILE}, records outside of {DOM_HOSTNAME}, invalid
+// owner names, TTLs beyond 2^31-1 and anything the zone parser cannot read.
+func validateZonefile(content []byte) error {
+	lines := strings.Split(string(content), "\n")
+	defaultZonefile := 0
+	for i, line := range lines {
+		if err := checkPlaceholders(line); err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if strings.TrimSpace(line) == "{DEFAULT_ZONEFILE}" {
+			// A second default zone would add another SOA record.
+			if defaultZonefile++; defaultZonefile > 1 {
+				return fmt.Errorf("line %d: {DEFAULT_ZONEFILE} appears more than once", i+1)
+			}
+			// Keep the line so the parser reports the right line numbers.
+			lines[i] = ""
+			continue
+		}
+		if strings.Contains(line, "{DEFAULT_ZONEFILE}") {
+			return fmt.Errorf("line %d: {DEFAULT_ZONEFILE} must be on its own line", i+1)
+		}
+		lines[i] = strings.ReplaceAll(line, "{DOM_HOSTNAME}", placeholderDomain)
+	}
+
+	origin := dns.Fqdn(placeholderDomain)
+	zp := dns.NewZoneParser(strings.NewReader(strings.Join(lines, "\n")), origin, "")
+	zp.SetDefaultTTL(3600)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		name := strings.ReplaceAll(h.Name, placeholderDomain, "{DOM_HOSTNAME}")
+		if !dns.IsSubDomain(origin, h.Name) {
+			return fmt.Errorf("owner name %s is not within {DOM_HOSTNAME}", name)
+		}
+		if strings.Count(h.Name, placeholderDomain) > 1 {
+			return fmt.Errorf("owner name %s contains {DOM_HOSTNAME} twice, missing trailing dot", name)
+		}
+		if err := checkOwnerName(strings.TrimSuffix(h.Name, origin)); err != nil {
+			return err
+		}
+		if h.Ttl > math.MaxInt32 {
+			return fmt.Errorf("ttl %d of %s exceeds %d", h.Ttl, name, math.MaxInt32)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkPlaceholders reports braces in line that do not form a known
+// placeholder, e.g. because a template escaped or truncated them.
+func checkPlaceholders(line string) error {
+	for rest := line; ; {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 {
+			return nil
+		}
+		if rest[i] == '}' {
+			return fmt.Errorf("unbalanced } in %q", line)
+		}
+		j := strings.IndexAny(rest[i+1:], "{}")
+		if j < 0 || rest[i+1+j] == '{' {
+			return fmt.Errorf("unterminated placeholder in %q", line)
+		}
+		if name := rest[i+1 : i+1+j]; !ZONEFILE_PLACEHOLDERS[name] {
+			return fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		rest = rest[i+j+2:]
+	}
+}
+
+// checkOwnerName allows letters, digits, hyphens and underscores in each
+// label of the part of an owner name in front of {DOM_HOSTNAME}, plus a
+// leading wildcard label.
+func checkOwnerName(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(prefix, "."), ".")
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid label %q in owner name %s{DOM_HOSTNAME}.", label, prefix)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid label %q in owner name %s{DOM_HOSTNAME}.", label, prefix)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateZonefile(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{"empty", "", ""},
+		{"default", "{DEFAULT_ZONEFILE}\nhome.{DOM_HOSTNAME}. 60 IN A 192.168.1.1\n\nhome.{DOM_HOSTNAME}. 60 IN AAAA 2001:db8::1", ""},
+		{"relative owner", "{DEFAULT_ZONEFILE}\nhome 60 IN A 192.168.1.1", ""},
+		{"wildcard and service labels", "*.home.{DOM_HOSTNAME}. 60 IN A 192.168.1.1\n_acme-challenge.home.{DOM_HOSTNAME}. 60 IN TXT \"token\"", ""},
+		{"unknown placeholder", "home.{DOM_USER}. 60 IN A 192.168.1.1", "unknown placeholder {DOM_USER}"},
+		{"unterminated placeholder", "home.{DOM_HOSTNAME. 60 IN A 192.168.1.1", "unterminated placeholder"},
+		{"unbalanced brace", "home.DOM_HOSTNAME}. 60 IN A 192.168.1.1", "unbalanced }"},
+		{"default zonefile twice", "{DEFAULT_ZONEFILE}\nhome 60 IN A 192.168.1.1\n{DEFAULT_ZONEFILE}", "line 3: {DEFAULT_ZONEFILE} appears more than once"},
+		{"default zonefile inline", "{DEFAULT_ZONEFILE} home 60 IN A 192.168.1.1", "must be on its own line"},
+		{"missing trailing dot", "home.{DOM_HOSTNAME} 60 IN A 192.168.1.1", "missing trailing dot"},
+		{"outside of domain", "home.example.com. 60 IN A 192.168.1.1", "not within {DOM_HOSTNAME}"},
+		{"invalid label", "ho!me.{DOM_HOSTNAME}. 60 IN A 192.168.1.1", `invalid label "ho!me"`},
+		{"leading hyphen", "-home.{DOM_HOSTNAME}. 60 IN A 192.168.1.1", `invalid label "-home"`},
+		{"ttl too large", "home.{DOM_HOSTNAME}. 3000000000 IN A 192.168.1.1", "exceeds 2147483647"},
+		{"broken address", "home.{DOM_HOSTNAME}. 60 IN A 192.168.1", "bad A A"},
+		{"broken record", "home.{DOM_HOSTNAME}. 60 IN", "expecting RR type"},
+	} {
+		err := validateZonefile([]byte(testCase.content))
+		if testCase.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", testCase.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+			t.Errorf("%s: error is %v instead of %q", testCase.name, err, testCase.expectedErr)
+		}
+	}
+}
+
+func TestFileBackend_RejectsInvalidZonefile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone.txt")
+	b := newFileBackend(path, newZonefile())
+	ipv4 := netip.MustParseAddr("192.168.1.1")
+
+	if _, err := b.Publish(subdomain{"home", 60, &ipv4, nil}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := zonefileWriteErrorsTotal.Value("")
+	if _, err := b.Publish(subdomain{"my home", 60, &ipv4, nil}); err == nil {
+		t.Fatalf("expected error for invalid subpart")
+	}
+	if got := zonefileWriteErrorsTotal.Value(""); got != failures+1 {
+		t.Errorf("zonefile write errors counter is %v instead of %v", got, failures+1)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("invalid zonefile replaced the live one: %q", after)
+	}
+
+	// Lines maintained by hand are part of the new zonefile as well.
+	broken := string(before) + "www.{DOM_HOSTNAME}. 3600 IN A 192.0.2\n"
+	if err := os.WriteFile(path, []byte(broken), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	updated := netip.MustParseAddr("192.168.1.2")
+	if _, err := b.Publish(subdomain{"home", 60, &updated, nil}); err == nil {
+		t.Fatalf("expected error for an invalid line outside of the markers")
+	}
+	if after, _ := os.ReadFile(path); string(after) != broken {
+		t.Errorf("invalid zonefile replaced the live one: %q", after)
+	}
+}
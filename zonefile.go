@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const DEFAULT_TEMPLATE = `{DEFAULT_ZONEFILE}
@@ -12,6 +21,13 @@ const DEFAULT_TEMPLATE = `{DEFAULT_ZONEFILE}
 {{ if .IPv6 }}{{ .Subpart }}.{DOM_HOSTNAME}. {{ .TTL }} IN AAAA {{ .IPv6 }}{{ end -}}
 {{- end -}}`
 
+// The rendered template is written between these markers. Everything else
+// in the zonefile is maintained by hand and preserved.
+const (
+	ZONEFILE_BEGIN_MARKER = "; BEGIN hostsharing-dyndns"
+	ZONEFILE_END_MARKER   = "; END hostsharing-dyndns"
+)
+
 type subdomain struct {
 	Subpart string
 	TTL     uint
@@ -47,3 +63,202 @@ func (tmpl *zonefile) Write(wr io.Writer) error {
 		Subdomain subdomain
 	}{Subdomain: tmpl.subdomain})
 }
+
+// fileBackend renders the zonefile with a zoneFileWriter and writes it to
+// filename, where Hostsharing picks it up.
+type fileBackend struct {
+	filename string
+	z        zoneFileWriter
+	// backups is the number of previous versions kept next to filename.
+	backups int
+}
+
+func newFileBackend(filename string, z zoneFileWriter) *fileBackend {
+	return &fileBackend{filename: filename, z: z}
+}
+
+func (b *fileBackend) Publish(s subdomain) (bool, error) {
+	b.z.Set(s)
+
+	var content bytes.Buffer
+	if err := b.z.Write(&content); err != nil {
+		zonefileWriteErrorsTotal.Inc("")
+		return false, fmt.Errorf("cannot render zonefile %s: %w", b.filename, err)
+	}
+
+	current, err := os.ReadFile(b.filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		zonefileWriteErrorsTotal.Inc("")
+		return false, fmt.Errorf("cannot read zonefile %s: %w", b.filename, err)
+	}
+	merged := mergeZonefile(current, content.Bytes(), s.Subpart)
+	// The merged content replaces the live zonefile, including the lines
+	// maintained by hand.
+	if err := validateZonefile(merged); err != nil {
+		zonefileWriteErrorsTotal.Inc("")
+		return false, fmt.Errorf("invalid zonefile %s: %w", b.filename, err)
+	}
+
+	// Rewriting identical content would only bump the modification time,
+	// so the zonefile is left alone.
+	if bytes.Equal(current, merged) {
+		return false, nil
+	}
+
+	if b.backups > 0 && len(current) > 0 {
+		if err := backupZonefile(b.filename, current, b.backups, time.Now()); err != nil {
+			zonefileWriteErrorsTotal.Inc("")
+			return false, err
+		}
+	}
+
+	if err := writeZonefile(b.filename, merged); err != nil {
+		zonefileWriteErrorsTotal.Inc("")
+		return false, err
+	}
+	return true, nil
+}
+
+// writeZonefile replaces filename atomically, so the name server never
+// reads a partly written zonefile. The mode of an existing file is kept.
+func writeZonefile(filename string, content []byte) error {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := writeFileAtomic(filename, content, perm); err != nil {
+		return fmt.Errorf("cannot write zonefile %s: %w", filename, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces filename with content via a temporary file in the
+// same directory, so readers see either the old or the new content.
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// mergeZonefile replaces the managed part of current with rendered. If
+// current has no markers yet, e.g. because it was written by hand or by an
+// older version, the lines also found in rendered and the A and AAAA records
+// of subpart are replaced instead. Lines outside the markers that are also
+// found in rendered, e.g. {DEFAULT_ZONEFILE}, are dropped so they are not
+// expanded twice. All other lines are kept as they are.
+func mergeZonefile(current, rendered []byte, subpart string) []byte {
+	block := []string{ZONEFILE_BEGIN_MARKER}
+	renderedLines := map[string]bool{}
+	if r := strings.TrimRight(string(rendered), "\n"); r != "" {
+		for _, line := range strings.Split(r, "\n") {
+			block = append(block, line)
+			if line = strings.TrimSpace(line); line != "" {
+				renderedLines[line] = true
+			}
+		}
+	}
+	block = append(block, ZONEFILE_END_MARKER)
+
+	lines := []string{}
+	if c := strings.TrimRight(string(current), "\n"); c != "" {
+		lines = strings.Split(c, "\n")
+	}
+
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case ZONEFILE_BEGIN_MARKER:
+			if begin < 0 {
+				begin = i
+			}
+		case ZONEFILE_END_MARKER:
+			if begin >= 0 && end < 0 {
+				end = i
+			}
+		}
+	}
+
+	out := []string{}
+	if begin >= 0 && end >= 0 {
+		outside := func(lines []string) []string {
+			kept := []string{}
+			for _, line := range lines {
+				if !renderedLines[strings.TrimSpace(line)] {
+					kept = append(kept, line)
+				}
+			}
+			return kept
+		}
+		out = append(out, outside(lines[:begin])...)
+		out = append(out, block...)
+		out = append(out, outside(lines[end+1:])...)
+	} else {
+		pos := -1
+		for _, line := range lines {
+			if renderedLines[strings.TrimSpace(line)] || isAddressRecordOf(line, subpart) {
+				if pos < 0 {
+					pos = len(out)
+				}
+				continue
+			}
+			out = append(out, line)
+		}
+		if pos < 0 {
+			pos = 0
+		}
+		out = append(out[:pos], append(block, out[pos:]...)...)
+	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// isAddressRecordOf reports whether line is an A or AAAA record owned by
+// subpart, either relative or as subpart.{DOM_HOSTNAME}.
+func isAddressRecordOf(line, subpart string) bool {
+	if subpart == "" || line == "" || line[0] == ' ' || line[0] == '\t' {
+		return false
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return false
+	}
+	owner := fields[0]
+	if !strings.EqualFold(owner, subpart) && !strings.EqualFold(owner, subpart+".{DOM_HOSTNAME}.") {
+		return false
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case f == "A" || f == "AAAA":
+			return true
+		case f == "IN":
+			continue
+		default:
+			if _, err := strconv.ParseUint(f, 10, 32); err != nil {
+				return false
+			}
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -45,3 +47,120 @@ foobar.{DOM_HOSTNAME}. 120 IN AAAA 2001:db8::68`},
 
 	}
 }
+
+func TestMergeZonefile(t *testing.T) {
+	rendered := "{DEFAULT_ZONEFILE}\nhome.{DOM_HOSTNAME}. 60 IN A 192.168.178.2\n"
+	block := "; BEGIN hostsharing-dyndns\n{DEFAULT_ZONEFILE}\nhome.{DOM_HOSTNAME}. 60 IN A 192.168.178.2\n; END hostsharing-dyndns\n"
+
+	for _, testCase := range []struct {
+		name     string
+		current  string
+		expected string
+	}{
+		{"new zonefile", "", block},
+		{
+			"markers",
+			"{DEFAULT_ZONEFILE}\n; mail\n; BEGIN hostsharing-dyndns\nhome.{DOM_HOSTNAME}. 60 IN A 10.0.0.1\n; END hostsharing-dyndns\nwww 3600 IN CNAME home\n",
+			"; mail\n" + block + "www 3600 IN CNAME home\n",
+		},
+		{
+			"without markers",
+			"{DEFAULT_ZONEFILE}\nhome.{DOM_HOSTNAME}. 60 IN A 10.0.0.1\nhome 60 IN AAAA 2001:db8::1\nhome.{DOM_HOSTNAME}. IN TXT \"keep\"\n@ IN MX 10 mail\n",
+			block + "home.{DOM_HOSTNAME}. IN TXT \"keep\"\n@ IN MX 10 mail\n",
+		},
+		{
+			"hand written",
+			"www IN A 192.0.2.80\n",
+			block + "www IN A 192.0.2.80\n",
+		},
+	} {
+		got := string(mergeZonefile([]byte(testCase.current), []byte(rendered), "home"))
+		if got != testCase.expected {
+			t.Errorf("%s: merged zonefile is %q instead of %q", testCase.name, got, testCase.expected)
+		}
+		if n := strings.Count(got, "{DEFAULT_ZONEFILE}"); n != 1 {
+			t.Errorf("%s: merged zonefile contains {DEFAULT_ZONEFILE} %d times", testCase.name, n)
+		}
+
+		// Merging again must not change anything, so unchanged updates
+		// are detected.
+		if again := string(mergeZonefile([]byte(got), []byte(rendered), "home")); again != got {
+			t.Errorf("%s: merge is not stable: %q != %q", testCase.name, again, got)
+		}
+	}
+}
+
+func TestIsAddressRecordOf(t *testing.T) {
+	for _, testCase := range []struct {
+		line     string
+		expected bool
+	}{
+		{"home.{DOM_HOSTNAME}. 60 IN A 192.168.178.2", true},
+		{"HOME.{DOM_HOSTNAME}. 60 IN AAAA 2001:db8::68", true},
+		{"home 60 A 192.168.178.2", true},
+		{"home IN A 192.168.178.2 ; comment", true},
+		{"home.{DOM_HOSTNAME}. 60 IN TXT \"A\"", false},
+		{"homer.{DOM_HOSTNAME}. 60 IN A 192.168.178.2", false},
+		{"  60 IN A 192.168.178.2", false},
+		{"; home 60 IN A 192.168.178.2", false},
+		{"", false},
+	} {
+		if got := isAddressRecordOf(testCase.line, "home"); got != testCase.expected {
+			t.Errorf("isAddressRecordOf(%q) is %v instead of %v", testCase.line, got, testCase.expected)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "state.json")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(filename, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("content is %q instead of %q", got, content)
+		}
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("mode is %v instead of 0600", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
+
+func TestWriteZonefile_KeepsMode(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "zone.txt")
+	if err := os.WriteFile(filename, []byte("old"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeZonefile(filename, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode is %v instead of 0640", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+
+	if err := writeZonefile(filepath.Join(dir, "missing", "zone.txt"), []byte("new")); err == nil || !strings.Contains(err.Error(), "cannot write zonefile") {
+		t.Errorf("error is %v for a missing directory", err)
+	}
+}